@@ -3,7 +3,9 @@ package lzss
 import (
 	"fmt"
 	"github.com/icza/bitio"
+	"io"
 	"math"
+	"math/bits"
 )
 
 const (
@@ -12,14 +14,22 @@ const (
 )
 
 const (
-	SymbolDynamic     byte = 0xFF
-	SymbolShort       byte = 0xFE
-	maxBackrefLenLog2      = 8  // max length of a backref in bytes (1 << 8 = 256 bytes)
-	shortAddrBits          = 14 // number of bits to encode the address in a short backref
+	SymbolDynamic      byte = 0xFF
+	SymbolShort        byte = 0xFE
+	SymbolMicro        byte = 0xFD // only reserved when micro backrefs are enabled, see WithMicroBackrefs
+	SymbolRaw          byte = 0xFC // only reserved when raw spans are enabled, see WithRawSpans
+	maxBackrefLenLog2       = 8    // max length of a backref in bytes (1 << 8 = 256 bytes)
+	longBackrefLenLog2      = 16   // max length of a backref in bytes when long backrefs are enabled (1 << 16 = 64KB)
+	shortAddrBits           = 14   // number of bits to encode the address in a short backref
+	dynamicAddrBits         = 21   // max number of bits to encode the address in a dynamic backref
+	microAddrBits           = 5    // number of bits to encode the address in a micro backref
+	microLenLog2            = 2    // max length of a micro backref in bytes (1 << 2 = 4 bytes)
+	rawLenLog2              = 16   // max length of a raw span in bytes (1 << 16 = 64KB)
 )
 
 type BackrefType struct {
-	Delimiter      byte
+	Delimiter      byte // SymbolShort, SymbolDynamic or SymbolMicro, whatever the symbol starting the backref
+	symbol         byte // the symbol starting the backref in the compressed stream, see WithDelimiters
 	NbBitsAddress  uint8
 	NbBitsLength   uint8
 	NbBitsBackRef  uint8
@@ -30,18 +40,37 @@ type BackrefType struct {
 }
 
 func NewShortBackrefType() (short BackrefType) {
-	short = newBackRefType(SymbolShort, shortAddrBits, maxBackrefLenLog2, 0)
-	return
+	return newShortBackrefType(maxBackrefLenLog2)
 }
 
 func NewDynamicBackrefType(dictLen, addressableBytes int) (dynamic BackrefType) {
-	bound := uint8(21)
-	return newBackRefType(SymbolDynamic, bound, maxBackrefLenLog2, dictLen)
+	return newDynamicBackrefType(dictLen, addressableBytes, maxBackrefLenLog2, false)
+}
+
+// newShortBackrefType is the same as NewShortBackrefType, with a custom length width
+func newShortBackrefType(nbBitsLength uint8) BackrefType {
+	return newBackRefType(SymbolShort, shortAddrBits, nbBitsLength, 0)
+}
+
+// newMicroBackrefType returns the type of micro backrefs, which cheaply encode very short repetitions close by
+func newMicroBackrefType() BackrefType {
+	return newBackRefType(SymbolMicro, microAddrBits, microLenLog2, 0)
+}
+
+// newDynamicBackrefType is the same as NewDynamicBackrefType, with a custom length width.
+// If adaptiveAddress is set, the address is only as wide as needed to reach the beginning of the dictionary.
+func newDynamicBackrefType(dictLen, addressableBytes int, nbBitsLength uint8, adaptiveAddress bool) BackrefType {
+	nbBitsAddress := uint8(dynamicAddrBits)
+	if adaptiveAddress {
+		nbBitsAddress = uint8(min(dynamicAddrBits, bits.Len(uint(max(dictLen+addressableBytes-1, 0)))))
+	}
+	return newBackRefType(SymbolDynamic, nbBitsAddress, nbBitsLength, dictLen)
 }
 
 func newBackRefType(symbol byte, nbBitsAddress, nbBitsLength uint8, dictLen int) BackrefType {
 	return BackrefType{
 		Delimiter:      symbol,
+		symbol:         symbol,
 		NbBitsAddress:  nbBitsAddress,
 		NbBitsLength:   nbBitsLength,
 		NbBitsBackRef:  8 + nbBitsAddress + nbBitsLength,
@@ -58,15 +87,40 @@ type backref struct {
 	bType   BackrefType
 }
 
+type writer interface {
+	TryWriteBits(v uint64, nbBits uint8)
+	TryWriteByte(b byte)
+}
+
 // Warning; writeTo and readFrom are not symmetrical
 
 func (b *backref) writeTo(w writer, i int) {
-	w.TryWriteByte(b.bType.Delimiter)
+	w.TryWriteByte(b.bType.symbol)
 	w.TryWriteBits(uint64(b.length-1), b.bType.NbBitsLength)
 	addrToWrite := (i + b.bType.DictLen) - b.address - 1
 	w.TryWriteBits(uint64(addrToWrite), b.bType.NbBitsAddress)
 }
 
+// readRawSpanLen reads the length of a raw span, the SymbolRaw delimiter excluded
+func readRawSpanLen(r *bitio.Reader) (int, error) {
+	n, err := r.ReadBits(rawLenLog2)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncatedStream // the stream ends in the middle of the span
+	}
+	return int(n) + 1, err
+}
+
+// readRawSpan appends the n bytes of a raw span, whose length was read by readRawSpanLen, to out
+func readRawSpan(r *bitio.Reader, out []byte, n int) ([]byte, error) {
+	start := len(out)
+	out = append(out, make([]byte, n)...)
+	_, err := io.ReadFull(r, out[start:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncatedStream // the stream ends in the middle of the span
+	}
+	return out, err
+}
+
 func (b *backref) readFrom(r *bitio.Reader) error {
 	n := r.TryReadBits(b.bType.NbBitsLength)
 	b.length = int(n) + 1
@@ -74,6 +128,9 @@ func (b *backref) readFrom(r *bitio.Reader) error {
 	n = r.TryReadBits(b.bType.NbBitsAddress)
 	b.address = int(n) + 1
 
+	if r.TryError == io.EOF || r.TryError == io.ErrUnexpectedEOF {
+		return ErrTruncatedStream // the stream ends in the middle of the backref
+	}
 	if r.TryError != nil {
 		return r.TryError
 	}
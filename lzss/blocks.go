@@ -0,0 +1,109 @@
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A block container is made of a header with Blocks set, followed by the number of blocks
+// and, for each block, its size in bytes and its contents.
+// Each block is a complete compressed stream, with its own header, and is decompressed independently of the others.
+// All numbers are 32-bit big-endian.
+const blockFieldSize = 4
+
+// streamedBlocks stands for the number of blocks of a container written without knowing it in advance,
+// see WindowedCompressor. The last block of such a container is followed by a size of 0 instead.
+const streamedBlocks = math.MaxUint32
+
+var errNestedBlocks = errors.New("block containers cannot be nested")
+
+// decompressBlocks appends the decompressed contents of the blocks of a container to out.
+// data is the container, minus its header.
+func decompressBlocks(out, data, dict []byte, opts decompressOptions) ([]byte, error) {
+	if len(data) < blockFieldSize {
+		return nil, ErrTruncatedStream
+	}
+	nbBlocks := binary.BigEndian.Uint32(data)
+	data = data[blockFieldSize:]
+
+	outStart := len(out)
+	bitsRead := 8 * (HeaderSize + blockFieldSize)
+	nextProgress := progressInterval
+
+	for i := uint32(0); nbBlocks == streamedBlocks || i < nbBlocks; i++ {
+		if len(data) < blockFieldSize {
+			return nil, ErrTruncatedStream
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[blockFieldSize:]
+		bitsRead += 8 * blockFieldSize
+		if size == 0 && nbBlocks == streamedBlocks {
+			break
+		}
+		if uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("block %d: %w", i, ErrTruncatedStream)
+		}
+		block := data[:size]
+		data = data[size:]
+
+		var header Header
+		if _, err := header.ReadFrom(bytes.NewReader(block)); err == nil && header.Blocks {
+			return nil, errNestedBlocks
+		}
+
+		blockOpts := decompressOptions{maxOut: opts.maxOut, dictCoverage: opts.dictCoverage, dictAugmented: opts.dictAugmented}
+		if opts.maxOut >= 0 {
+			blockOpts.maxOut -= len(out) - outStart
+		}
+		if opts.progress != nil {
+			bitsOffset, outOffset := bitsRead, len(out)-outStart
+			blockOpts.progress = func(compressedBitsRead, decompressedBytes int) {
+				if outOffset+decompressedBytes >= nextProgress {
+					opts.progress(bitsOffset+compressedBitsRead, outOffset+decompressedBytes)
+					nextProgress = outOffset + decompressedBytes + progressInterval
+				}
+			}
+		}
+
+		var err error
+		if out, err = decompress(out, block, dict, blockOpts); err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, err)
+		}
+		bitsRead += 8 * int(size)
+	}
+
+	if len(data) != 0 {
+		return nil, errors.New("trailing data after the last block")
+	}
+	if opts.progress != nil {
+		opts.progress(bitsRead, len(out)-outStart)
+	}
+	return out, nil
+}
+
+// containerSize returns the size in bytes of the block container at the beginning of data, header included.
+func containerSize(data []byte) (int, error) {
+	n := HeaderSize + blockFieldSize
+	if len(data) < n {
+		return 0, ErrTruncatedStream
+	}
+	nbBlocks := binary.BigEndian.Uint32(data[HeaderSize:])
+	for i := uint32(0); nbBlocks == streamedBlocks || i < nbBlocks; i++ {
+		if len(data)-n < blockFieldSize {
+			return 0, ErrTruncatedStream
+		}
+		size := binary.BigEndian.Uint32(data[n:])
+		n += blockFieldSize
+		if size == 0 && nbBlocks == streamedBlocks {
+			break
+		}
+		if uint64(size) > uint64(len(data)-n) {
+			return 0, fmt.Errorf("block %d: %w", i, ErrTruncatedStream)
+		}
+		n += int(size)
+	}
+	return n, nil
+}
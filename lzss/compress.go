@@ -1,8 +1,14 @@
+//go:build !decompressonly
+
 package lzss
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
+	"math"
 
 	"github.com/consensys/compress/lzss/internal/suffixarray"
 	"github.com/icza/bitio"
@@ -19,88 +25,261 @@ type Compressor struct {
 	lastOutLen        int
 	lastNbSkippedBits uint8
 	lastInLen         int
+	lastStats         writeStats
+
+	stats writeStats // statistics of the current compressed stream
+
+	checkpoints []checkpoint
+	generation  int // incremented whenever the output is rebuilt from scratch, which invalidates the output recorded by checkpoints
 
-	inputIndex *suffixarray.Index
-	inputSa    [MaxInputSize]int32 // suffix array space.
+	inputIndex      *suffixarray.Index // index of the input, starting at inputIndexStart
+	inputIndexStart int
+	inputSa         []int32 // suffix array space.
+	maxInputSize    int
 
-	dictData        []byte
-	dictIndex       *suffixarray.Index
-	dictSa          [MaxDictSize]int32 // suffix array space.
-	dictReservedIdx map[byte]int       // stores the index of the reserved symbols in the dictionary
+	dictData  []byte
+	dictIndex *suffixarray.Index
+	dictSa    []int32 // suffix array space.
 
 	noCompression bool
+
+	settings compressorSettings
+	header   Header // header of the compressed data
+
+	trace func(pos int, decision Decision) // debug hook, see SetDecisionTrace
+	ctx   context.Context                  // checked periodically while compressing, see CompressCtx
+}
+
+// Decision describes a single emission made by the compressor, along with the alternatives it considered.
+type Decision struct {
+	Type           byte // 0 for a literal, SymbolShort or SymbolDynamic for a backref
+	Length         int  // number of input bytes covered by the emission
+	Address        int  // address of the backref, as used by BackrefType; -1 for a literal
+	FromDict       bool // true if the backref points into the dictionary
+	ShortSavings   int  // savings in bits of the best short backref considered; math.MinInt if none was considered
+	DynamicSavings int  // savings in bits of the best dynamic backref considered; math.MinInt if none was considered
+	MicroSavings   int  // savings in bits of the best micro backref considered; math.MinInt if none was considered
+}
+
+// compressorSettings holds the options a compressor was created with
+type compressorSettings struct {
+	backrefLenLog2    uint8
+	microBackrefs     bool
+	adaptiveAddresses bool
+	dictFingerprint   bool
+	minRepeatingBytes int // shortest run of a single byte handled by the RLE fast path
+	lookahead         int // number of positions after the current one searched for a better backref
+	rawSpans          bool
+	customDelimiters  bool
+	shortDelimiter    byte
+	dynamicDelimiter  byte
+}
+
+// Option configures a compressor at creation time.
+type Option func(*compressorSettings)
+
+// WithLongBackrefs encodes backref lengths on 16 bits, so that a single backref can cover up to 64KB instead of 256 bytes.
+// This benefits data with very long repetitions, at the cost of one extra byte per backref.
+func WithLongBackrefs() Option {
+	return func(s *compressorSettings) {
+		s.backrefLenLog2 = longBackrefLenLog2
+	}
+}
+
+// WithMicroBackrefs enables micro backrefs, which encode repetitions of 2 to 4 bytes found at most 32 bytes back on 15 bits.
+// SymbolMicro is then reserved, and can no longer be encoded as a literal, so this only pays off on data with
+// many short repetitions and few occurrences of SymbolMicro. On testdata/average_block.hex, the two effects
+// roughly cancel out; see BenchmarkMicroBackrefs.
+func WithMicroBackrefs() Option {
+	return func(s *compressorSettings) {
+		s.microBackrefs = true
+	}
+}
+
+// WithAdaptiveAddresses encodes the address of dynamic backrefs on as few bits as needed to reach the beginning
+// of the dictionary, rather than on 21 bits. This only makes a difference while the dictionary and the data compressed
+// so far add up to less than 1MB, so it benefits small inputs compressed with a small dictionary the most.
+// With testdata/dict_naive, it improves the compression ratio of testdata/blobs/1-goerli-3690632 from 23.8 to 24.4.
+func WithAdaptiveAddresses() Option {
+	return func(s *compressorSettings) {
+		s.adaptiveAddresses = true
+	}
+}
+
+// WithoutRLE disables the fast path handling runs of at least 160 occurrences of a single byte, so that they go through
+// the same backref selection as the rest of the input. On testdata/blobs, the compressed sizes change by at most 20 bytes
+// either way. The cost is speed: the index lookups become quadratic in the length of a run,
+// so that 16KB of zeros take about 100ms to compress instead of 100µs.
+func WithoutRLE() Option {
+	return func(s *compressorSettings) {
+		s.minRepeatingBytes = math.MaxInt
+	}
+}
+
+// defaultRLEThreshold is the shortest run of a single byte handled by the RLE fast path, unless set by WithRLEThreshold
+const defaultRLEThreshold = 160
+
+// WithRLEThreshold sets the shortest run of a single byte, at least 2, handled by the fast path emitting it as a single
+// backref; the default is 160. Runs too long for a single backref are split, so thresholds above its maximum length
+// disable the fast path as WithoutRLE does. Shorter runs go through the general backref selection instead.
+// On testdata/blobs with testdata/dict_naive, lowering the threshold makes the output bigger, by 0.1% at 80 and 6% at 20.
+func WithRLEThreshold(n int) Option {
+	return func(s *compressorSettings) {
+		s.minRepeatingBytes = n
+	}
+}
+
+// WithDelimiters sets the symbols starting short and dynamic backrefs, instead of SymbolShort and SymbolDynamic,
+// and records them in the header. These symbols can only be encoded as backrefs of length 1, which are much bigger
+// than literals, so data where SymbolShort or SymbolDynamic are common compresses better with rarer delimiters.
+// They must be different, and must not be SymbolMicro or SymbolRaw if these are also reserved.
+func WithDelimiters(short, dynamic byte) Option {
+	return func(s *compressorSettings) {
+		s.customDelimiters = true
+		s.shortDelimiter, s.dynamicDelimiter = short, dynamic
+	}
+}
+
+// WithRawSpans enables WriteRaw, which stores spans of data verbatim. SymbolRaw is then reserved, and can no longer
+// be encoded as a literal elsewhere.
+func WithRawSpans() Option {
+	return func(s *compressorSettings) {
+		s.rawSpans = true
+	}
+}
+
+// maxLookahead is the largest lookahead depth accepted by WithLookahead
+const maxLookahead = 16
+
+// WithLookahead sets how many of the following positions, at most 16, the compressor searches for a better backref
+// before emitting the best one found at the current position, writing the bytes in between as literals. The default is 2.
+// Each step costs an extra backref search per position. A backref k positions ahead is preferred if it saves more than
+// k bits over the current one, so deeper searches get greedier: on testdata/blobs, with testdata/dict_naive,
+// a depth of 3 changes compressed sizes by -0.02% to +0.3%, and deeper ones only make them worse.
+// A depth of 0 compresses two to three times as fast, at the cost of 4% to 9% in size.
+func WithLookahead(depth int) Option {
+	return func(s *compressorSettings) {
+		s.lookahead = depth
+	}
+}
+
+// WithDictFingerprint includes a 4-byte fingerprint of the dictionary in the header, so that decompressing
+// with a different dictionary fails with ErrDictMismatch instead of producing garbage.
+// Data for which compression is bypassed does not depend on the dictionary, and carries no fingerprint.
+func WithDictFingerprint() Option {
+	return func(s *compressorSettings) {
+		s.dictFingerprint = true
+	}
+}
+
+func newCompressorSettings(opts []Option) compressorSettings {
+	s := compressorSettings{backrefLenLog2: maxBackrefLenLog2, minRepeatingBytes: defaultRLEThreshold, lookahead: 2}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// check rejects invalid settings
+func (s *compressorSettings) check() error {
+	if s.lookahead < 0 || s.lookahead > maxLookahead {
+		return fmt.Errorf("lookahead depth must be in [0, %d]", maxLookahead)
+	}
+	if s.minRepeatingBytes < 2 {
+		return errors.New("RLE threshold must be at least 2")
+	}
+	h := s.header()
+	return h.check()
+}
+
+// header returns the header of compressed data produced with these settings, except for the dictionary fingerprint
+func (s *compressorSettings) header() Header {
+	return Header{
+		Version:           Version,
+		LongBackrefs:      s.backrefLenLog2 == longBackrefLenLog2,
+		MicroBackrefs:     s.microBackrefs,
+		AdaptiveAddresses: s.adaptiveAddresses,
+		RawSpans:          s.rawSpans,
+		CustomDelimiters:  s.customDelimiters,
+		ShortDelimiter:    s.shortDelimiter,
+		DynamicDelimiter:  s.dynamicDelimiter,
+	}
 }
 
 // NewCompressor returns a new compressor with the given dictionary
 // The dictionary is an unstructured sequence of substrings that are expected to occur frequently in the data. It is not included in the compressed data and should thus be a-priori known to both the compressor and the decompressor.
 // The level determines the bit alignment of the compressed data. The "higher" the level, the better the compression ratio but the more constraints on the decompressor.
-func NewCompressor(dict []byte) (*Compressor, error) {
-	dict = AugmentDict(dict)
+func NewCompressor(dict []byte, opts ...Option) (*Compressor, error) {
+	return NewCompressorWithLimits(dict, MaxInputSize, opts...)
+}
+
+// NewCompressorWithLimits returns a new compressor with the given dictionary, accepting at most maxInputSize bytes of input.
+// The memory footprint of the compressor is proportional to maxInputSize, so a small limit is useful
+// when many compressors are kept alive at once.
+func NewCompressorWithLimits(dict []byte, maxInputSize int, opts ...Option) (*Compressor, error) {
+	if maxInputSize <= 0 || maxInputSize > MaxInputSize {
+		return nil, fmt.Errorf("max input size must be in (0, %d]", MaxInputSize)
+	}
+	settings := newCompressorSettings(opts)
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	header := settings.header()
+	dict = augmentDict(dict, header.reservedSymbols()...)
 	if len(dict) > MaxDictSize {
 		return nil, fmt.Errorf("dict size must be <= %d", MaxDictSize)
 	}
+	dictSa := make([]int32, len(dict))
+	return newCompressor(dict, suffixarray.New(dict, dictSa), dictSa, maxInputSize, settings), nil
+}
+
+// newCompressor returns a new compressor using an already indexed dictionary
+func newCompressor(dict []byte, dictIndex *suffixarray.Index, dictSa []int32, maxInputSize int, settings compressorSettings) *Compressor {
 	c := &Compressor{
-		dictData:        dict,
-		dictReservedIdx: make(map[byte]int),
+		dictData:     dict,
+		dictIndex:    dictIndex,
+		dictSa:       dictSa,
+		inputSa:      make([]int32, maxInputSize),
+		maxInputSize: maxInputSize,
+		settings:     settings,
+		header:       settings.header(),
 	}
-
-	// find the reserved symbols in the dictionary
-	for i, b := range dict {
-		if b == SymbolDynamic {
-			c.dictReservedIdx[SymbolDynamic] = i
-		} else if b == SymbolShort {
-			c.dictReservedIdx[SymbolShort] = i
-		} else {
-			continue
-		}
-		if len(c.dictReservedIdx) == 2 {
-			break
-		}
+	if settings.dictFingerprint {
+		c.header.HasDictFingerprint = true
+		c.header.DictFingerprint = dictFingerprint(dict)
 	}
 
-	c.outBuf.Grow(MaxInputSize)
-	c.inBuf.Grow(1 << 19)
+	c.outBuf.Grow(maxInputSize)
+	c.inBuf.Grow(min(1<<19, maxInputSize))
 	c.bw = bitio.NewWriter(&c.outBuf)
-	c.dictIndex = suffixarray.New(c.dictData, c.dictSa[:len(c.dictData)])
 	c.Reset()
-	return c, nil
+	return c
 }
 
-// AugmentDict ensures the dictionary contains the special symbols
-func AugmentDict(dict []byte) []byte {
-
-	found := uint8(0)
-	const mask uint8 = 0b110
-	for _, b := range dict {
-		if b == SymbolShort {
-			found |= 0b010
-		} else if b == SymbolDynamic {
-			found |= 0b100
-		} else {
-			continue
-		}
-		if found == mask {
-			return dict
-		}
-	}
-
-	return append(dict, SymbolShort, SymbolDynamic)
+// SetDecisionTrace registers a debug hook invoked for every emission committed by the compressor,
+// in the order they appear in the compressed stream. pos is the index of the first input byte covered by the emission.
+// The hook is also invoked by CompressStateless, CompressedSize256k, CompressedSize and DictSavingsBits,
+// which are then no longer thread-safe.
+// Passing nil disables tracing.
+func (compressor *Compressor) SetDecisionTrace(fn func(pos int, decision Decision)) {
+	compressor.trace = fn
 }
 
 // The compressor cannot recover from a Write error. It must be Reset before writing again
+// If the input holds a reserved symbol that no backref can reach, which takes megabytes of input with neither a copy
+// of the symbol in the last 2MB nor one in the reachable part of the dictionary, compression is bypassed.
 func (compressor *Compressor) Write(d []byte) (n int, err error) {
 
-	// reconstruct bit writer cache
-	compressor.lastOutLen = compressor.outBuf.Len()
-	lastByte := compressor.outBuf.Bytes()[compressor.outBuf.Len()-1]
-	compressor.outBuf.Truncate(compressor.outBuf.Len() - 1)
-	lastByte >>= compressor.nbSkippedBits
-	if err = compressor.bw.WriteBits(uint64(lastByte), 8-compressor.nbSkippedBits); err != nil {
-		return
+	if len(d) == 0 {
+		// nothing to compress; a subsequent Revert is a no-op, see Revert
+		compressor.lastOutLen = compressor.outBuf.Len()
+		compressor.lastNbSkippedBits = compressor.nbSkippedBits
+		compressor.lastStats = compressor.stats
+		compressor.lastInLen = compressor.inBuf.Len()
+		return 0, nil
 	}
 
-	compressor.lastNbSkippedBits = compressor.nbSkippedBits
-	if err = compressor.appendInput(d); err != nil {
+	if err = compressor.beginWrite(d); err != nil {
 		return
 	}
 
@@ -112,10 +291,20 @@ func (compressor *Compressor) Write(d []byte) (n int, err error) {
 
 	d = compressor.inBuf.Bytes()
 
-	// build the index
-	compressor.inputIndex = suffixarray.New(d, compressor.inputSa[:len(d)])
-
-	n, err = compressor.write(compressor.bw, d, compressor.lastInLen, compressor.inputIndex)
+	// build the index; only the part of the input within reach of the new data needs indexing.
+	// The window is 2MB long, so this only bounds the cost of a Write once the input exceeds it:
+	// writing many small chunks still reindexes up to 2MB of input each time
+	compressor.inputIndexStart = max(0, compressor.lastInLen-maxWindowSize)
+	indexed := d[compressor.inputIndexStart:]
+	compressor.inputIndex = suffixarray.New(indexed, compressor.inputSa[:len(indexed)])
+
+	n, err = compressor.write(compressor.bw, d, compressor.lastInLen, compressor.inputIndex, compressor.inputIndexStart, &compressor.stats)
+	if errors.Is(err, errOutOfReach) {
+		// the input cannot be compressed, but it can always be stored as is
+		compressor.flushBitWriter()
+		compressor.bypass()
+		return len(d) - compressor.lastInLen, nil
+	}
 	if err != nil {
 		return
 	}
@@ -128,78 +317,220 @@ func (compressor *Compressor) Write(d []byte) (n int, err error) {
 	return
 }
 
-type writer interface {
-	TryWriteBits(v uint64, nbBits uint8)
-	TryWriteByte(b byte)
+// beginWrite records the state to revert to, appends d to the input and reconstructs the bit writer cache
+func (compressor *Compressor) beginWrite(d []byte) error {
+	// check the size before touching the output, so that an oversized write leaves the compressor as it was
+	if err := compressor.appendInput(d); err != nil {
+		return err
+	}
+
+	compressor.lastOutLen = compressor.outBuf.Len()
+	lastByte := compressor.outBuf.Bytes()[compressor.outBuf.Len()-1]
+	compressor.outBuf.Truncate(compressor.outBuf.Len() - 1)
+	lastByte >>= compressor.nbSkippedBits
+	if err := compressor.bw.WriteBits(uint64(lastByte), 8-compressor.nbSkippedBits); err != nil {
+		return err
+	}
+
+	compressor.lastNbSkippedBits = compressor.nbSkippedBits
+	compressor.lastStats = compressor.stats
+	return nil
+}
+
+// WriteRaw appends d to the input, storing it verbatim instead of compressing it. This saves the time spent searching
+// for backrefs in data known to be incompressible, and bounds its expansion to 3 bytes per 64KB.
+// Later input may still refer back to d. It requires WithRawSpans, and can be reverted like Write.
+// If compression is bypassed, WriteRaw is the same as Write.
+// Checkpoint and RevertTo may recompress the input, in which case d is compressed like the rest of the input.
+func (compressor *Compressor) WriteRaw(d []byte) error {
+	if !compressor.settings.rawSpans {
+		return errors.New("raw spans are not enabled; see WithRawSpans")
+	}
+	if len(d) == 0 || compressor.noCompression {
+		_, err := compressor.Write(d)
+		return err
+	}
+
+	if err := compressor.beginWrite(d); err != nil {
+		return err
+	}
+	compressor.stats.rawBytes += len(d)
+	for len(d) != 0 {
+		n := min(len(d), 1<<rawLenLog2)
+		compressor.bw.TryWriteByte(SymbolRaw)
+		compressor.bw.TryWriteBits(uint64(n-1), rawLenLog2)
+		for _, b := range d[:n] {
+			compressor.bw.TryWriteByte(b)
+		}
+		d = d[n:]
+	}
+	if compressor.bw.TryError != nil {
+		return compressor.bw.TryError
+	}
+
+	var err error
+	compressor.nbSkippedBits, err = compressor.bw.Align()
+	return err
+}
+
+// writeStats records statistics about the emissions made by write
+type writeStats struct {
+	rleInvocations int // number of times the RLE fast path was taken
+	rleBytes       int // number of input bytes covered by the RLE fast path
+
+	literals [256]int // number of times each byte value was emitted as a literal
+	rawBytes int      // number of bytes stored verbatim by WriteRaw
+
+	dictSavings int // total savings, in bits, of the backrefs into the dictionary
+
+	// number of backrefs of each length, minus one; longer backrefs are counted in the last entry
+	shortLengths, dynamicLengths, dictLengths [1 << maxBackrefLenLog2]int
+	microLengths                              [1 << microLenLog2]int
+}
+
+// CompressionStats summarizes the emissions making up a compressed stream.
+type CompressionStats struct {
+	Literals        int // number of input bytes emitted as literals
+	ShortBackrefs   int
+	DynamicBackrefs int // dynamic backrefs into the input; those into the dictionary are counted in DictBackrefs
+	DictBackrefs    int
+	MicroBackrefs   int
+	RawBytes        int // number of input bytes stored verbatim by WriteRaw
+
+	// histograms of backref lengths; entry i counts the backrefs of length i+1,
+	// except for the last entry which also counts the longer backrefs enabled by WithLongBackrefs
+	ShortLengths, DynamicLengths, DictLengths [1 << maxBackrefLenLog2]int
+	MicroLengths                              [1 << microLenLog2]int
 }
 
 // write compresses the data and writes it to the writer
 // note that this is meant to be stateless and not modify the compressor object.
-func (compressor *Compressor) write(w writer, d []byte, startIndex int, inputIndex *suffixarray.Index) (n int, err error) {
+// inputIndex indexes d[inputIndexStart:], which must cover everything within reach of d[startIndex:].
+// If stats is not nil, it is updated with the emissions made.
+func (compressor *Compressor) write(w writer, d []byte, startIndex int, inputIndex *suffixarray.Index, inputIndexStart int, stats *writeStats) (n int, err error) {
 	dictLen := len(compressor.dictData)
 
-	shortType := NewShortBackrefType()
+	shortType := compressor.header.shortBackrefType()
+	microType := newMicroBackrefType()
 
-	// we use a circular buffer to store the last 3 backrefs
-	cb := newCircularBuffer()
+	// we use a circular buffer to store the backrefs found at the current position and the ones looked ahead
+	cb := newCircularBuffer(compressor.settings.lookahead + 1)
 
 	bestBackref := func(at int) (backref, int) {
 		if b, ok := cb.best(at); ok {
 			return b, b.savings()
 		}
 
-		bDynamic := backref{bType: NewDynamicBackrefType(dictLen, at), length: -1, address: -1}
+		bDynamic := backref{bType: compressor.dynamicBackrefType(at), length: -1, address: -1}
 		bShort := backref{bType: shortType, length: -1, address: -1}
+		bMicro := backref{bType: microType, length: -1, address: -1}
 
 		// we haven't computed the backref yet
 		minLen := -1
-		if !canEncodeSymbol(d[at]) {
+		if !compressor.canEncodeSymbol(d[at]) {
 			minLen = 1
 		}
 
-		bShort.address, bShort.length = findBackRef(d, at, shortType, minLen, inputIndex, compressor.dictIndex, dictLen)
-		bDynamic.address, bDynamic.length = findBackRef(d, at, bDynamic.bType, minLen, inputIndex, compressor.dictIndex, dictLen)
-
-		// we store the best backref in the circular buffer
-		var bestAtI backref
-		if bShort.length != -1 && bShort.savings() > bDynamic.savings() {
-			bestAtI = bShort
-		} else {
-			bestAtI = bDynamic
+		bShort.address, bShort.length = findBackRef(d, at, shortType, minLen, inputIndex, inputIndexStart, compressor.dictIndex, dictLen)
+		bDynamic.address, bDynamic.length = findBackRef(d, at, bDynamic.bType, minLen, inputIndex, inputIndexStart, compressor.dictIndex, dictLen)
+		if compressor.settings.microBackrefs {
+			bMicro.address, bMicro.length = findMicroBackRef(d, at, microType)
 		}
 
-		cb.push(bestAtI, at)
+		// we store the candidates in the circular buffer
+		cb.push(bShort, bDynamic, bMicro, at)
+		bestAtI, _ := cb.best(at)
 		return bestAtI, bestAtI.savings()
 	}
 
-	const minRepeatingBytes = 160
+	// emit writes a backref (or a literal if b is nil) at i and reports the decision to the trace hook, if any
+	emit := func(b *backref, i int) {
+		if b == nil {
+			w.TryWriteByte(d[i])
+			if stats != nil {
+				stats.literals[d[i]]++
+			}
+		} else {
+			b.writeTo(w, i)
+			if stats != nil {
+				l := min(b.length, len(stats.shortLengths)) - 1
+				switch {
+				case b.bType.Delimiter == SymbolShort:
+					stats.shortLengths[l]++
+				case b.bType.Delimiter == SymbolMicro:
+					stats.microLengths[l]++
+				case b.address < dictLen:
+					stats.dictLengths[l]++
+					stats.dictSavings += b.savings()
+				default:
+					stats.dynamicLengths[l]++
+				}
+			}
+		}
+		if compressor.trace == nil {
+			return
+		}
+		decision := Decision{Length: 1, Address: -1, ShortSavings: math.MinInt, DynamicSavings: math.MinInt, MicroSavings: math.MinInt}
+		if bShort, bDynamic, bMicro, ok := cb.candidates(i); ok {
+			decision.ShortSavings, decision.DynamicSavings, decision.MicroSavings = bShort.savings(), bDynamic.savings(), bMicro.savings()
+		}
+		if b != nil {
+			decision.Type = b.bType.Delimiter
+			decision.Length = b.length
+			decision.Address = b.address
+			decision.FromDict = b.bType.Delimiter == SymbolDynamic && b.address < dictLen
+			switch b.bType.Delimiter {
+			case SymbolShort:
+				decision.ShortSavings = max(decision.ShortSavings, b.savings())
+			case SymbolMicro:
+				decision.MicroSavings = max(decision.MicroSavings, b.savings())
+			default:
+				decision.DynamicSavings = max(decision.DynamicSavings, b.savings())
+			}
+		}
+		compressor.trace(i, decision)
+	}
+
+	minRepeatingBytes := compressor.settings.minRepeatingBytes
+	nextCtxCheck := startIndex
 	for i := startIndex; i < len(d); {
+		if compressor.ctx != nil && i >= nextCtxCheck {
+			if err = compressor.ctx.Err(); err != nil {
+				return 0, err
+			}
+			nextCtxCheck = i + ctxCheckInterval
+		}
+
 		// if we have a series of repeating bytes, we can do "RLE" using a short backref
-		// note that since all our backref have max len of (1<<maxBackrefLenLog2)
-		// we stop if we have a series of repeating bytes of length (1<<maxBackrefLenLog2)
+		// note that since all our backref have max len of shortType.maxLength
+		// we stop if we have a series of repeating bytes of that length
 		count := 0
-		for i+count < len(d) && count < (1<<maxBackrefLenLog2) && d[i] == d[i+count] {
+		for i+count < len(d) && count < shortType.maxLength && d[i] == d[i+count] {
 			count++
 		}
 		if count >= minRepeatingBytes {
 			// we have a series of repeating bytes which would make a reasonable backref
 			// let's use this path for perf reasons.
+			if stats != nil {
+				stats.rleInvocations++
+				stats.rleBytes += count
+			}
 
 			// first, we need to ensure the previous byte is the same to have the start point for the backref
 
 			// we write the symbol at i
 			if !(i > 0 && d[i-1] == d[i]) {
-				if !canEncodeSymbol(d[i]) {
-					// if this is a reserved symbol, it should be in the dictionary
+				if !compressor.canEncodeSymbol(d[i]) {
+					// if this is a reserved symbol, it should be in the dictionary or the window
 					// (this is a backref with len(1))
-					bDict := backref{
-						bType:   NewDynamicBackrefType(dictLen, i),
-						address: compressor.dictReservedIdx[d[i]],
-						length:  1,
+					bDict := backref{bType: compressor.dynamicBackrefType(i)}
+					bDict.address, bDict.length = findBackRef(d[:i+1], i, bDict.bType, 1, inputIndex, inputIndexStart, compressor.dictIndex, dictLen)
+					if bDict.length == -1 {
+						return 0, errSymbolOutOfReach(d[i], i)
 					}
-					bDict.writeTo(w, i)
+					emit(&bDict, i)
 				} else {
-					w.TryWriteByte(d[i])
+					emit(nil, i)
 				}
 				i++
 				count--
@@ -207,100 +538,157 @@ func (compressor *Compressor) write(w writer, d []byte, startIndex int, inputInd
 			} // else --> we do a backref of length count at i
 
 			bShort := backref{bType: shortType, address: i - 1, length: count}
-			bDynamic := backref{bType: NewDynamicBackrefType(dictLen, i), address: dictLen + i - 1, length: count}
+			bDynamic := backref{bType: compressor.dynamicBackrefType(i), address: dictLen + i - 1, length: count}
 			if bShort.savings() > bDynamic.savings() {
-				bShort.writeTo(w, i)
+				emit(&bShort, i)
 			} else {
-				bDynamic.writeTo(w, i)
+				emit(&bDynamic, i)
 			}
 			i += count
 			continue
 		}
 
 		bestAtI, bestSavings := bestBackref(i)
-		if !canEncodeSymbol(d[i]) {
+		if !compressor.canEncodeSymbol(d[i]) {
 			// at minima, we have a backref of length 1 in the dictionary
-			bestAtI.writeTo(w, i)
+			if bestAtI.length == -1 {
+				return 0, errSymbolOutOfReach(d[i], i)
+			}
+			emit(&bestAtI, i)
 			i += bestAtI.length
 			continue
 		}
 		if bestSavings < 0 {
 			// we didn't find a backref, let's write the symbol directly
-			w.TryWriteByte(d[i])
+			emit(nil, i)
 			i++
 			continue
 		}
 
 		// for the next few bytes, we will try to find a better backref
-		if i+1 < len(d) {
-			if _, newSavings := bestBackref(i + 1); newSavings > bestSavings+1 {
-				// we found a better backref at i+1
-				w.TryWriteByte(d[i])
-				i++
-				continue
+		skip := 0
+		for k := 1; k <= compressor.settings.lookahead && i+k < len(d); k++ {
+			if k > 1 && !compressor.canEncodeSymbol(d[i+k-1]) {
+				break // the bytes before the better backref must be written as literals
+			}
+			if _, newSavings := bestBackref(i + k); newSavings > bestSavings+k {
+				skip = k
+				break
 			}
 		}
-		if i+2 < len(d) && canEncodeSymbol(d[i+1]) {
-			// maybe at i+2 ? (we already tried i+1)
-			if _, newSavings := bestBackref(i + 2); newSavings > bestSavings+2 {
-				// we found a better backref
-				// write the symbol at i and i+1
-				w.TryWriteByte(d[i])
-				w.TryWriteByte(d[i+1])
-				i += 2
-				continue
+		if skip != 0 {
+			// we found a better backref at i+skip
+			// write the symbols before it
+			for j := i; j < i+skip; j++ {
+				emit(nil, j)
 			}
+			i += skip
+			continue
 		}
 
-		bestAtI.writeTo(w, i)
+		emit(&bestAtI, i)
 		i += bestAtI.length
 	}
 
 	return len(d) - startIndex, nil
 }
 
-const circularBufferSize = 3
-
 type circularBuffer struct {
-	k           int
-	keys        [circularBufferSize]int
-	bestBackref [circularBufferSize]backref
+	k       int
+	keys    []int
+	short   []backref
+	dynamic []backref
+	micro   []backref
 }
 
-func newCircularBuffer() *circularBuffer {
-	return &circularBuffer{keys: [circularBufferSize]int{-1, -1, -1}}
+func newCircularBuffer(size int) *circularBuffer {
+	cb := &circularBuffer{
+		keys:    make([]int, size),
+		short:   make([]backref, size),
+		dynamic: make([]backref, size),
+		micro:   make([]backref, size),
+	}
+	for i := range cb.keys {
+		cb.keys[i] = -1
+	}
+	return cb
 }
 
-func (cb *circularBuffer) push(b backref, at int) {
+func (cb *circularBuffer) push(short, dynamic, micro backref, at int) {
 	cb.keys[cb.k] = at
-	cb.bestBackref[cb.k] = b
-	cb.k = (cb.k + 1) % circularBufferSize
+	cb.short[cb.k] = short
+	cb.dynamic[cb.k] = dynamic
+	cb.micro[cb.k] = micro
+	cb.k = (cb.k + 1) % len(cb.keys)
 }
 
-func (cb *circularBuffer) best(at int) (backref, bool) {
-	for i := 0; i < circularBufferSize; i++ {
+// candidates returns the short, dynamic and micro backrefs considered at the given index
+func (cb *circularBuffer) candidates(at int) (short, dynamic, micro backref, ok bool) {
+	for i := range cb.keys {
 		if cb.keys[i] == at {
-			return cb.bestBackref[i], true
+			return cb.short[i], cb.dynamic[i], cb.micro[i], true
 		}
 	}
-	return backref{}, false
+	return backref{}, backref{}, backref{}, false
+}
+
+func (cb *circularBuffer) best(at int) (backref, bool) {
+	short, dynamic, micro, ok := cb.candidates(at)
+	if !ok {
+		return backref{}, false
+	}
+	best := dynamic
+	if short.length != -1 && short.savings() > best.savings() {
+		best = short
+	}
+	if micro.length != -1 && micro.savings() > best.savings() {
+		best = micro
+	}
+	return best, true
 }
 
 func (compressor *Compressor) Reset() {
-	compressor.noCompression = false
+	compressor.flushBitWriter()
 	compressor.outBuf.Reset()
-	header := Header{
-		Version:       Version,
-		NoCompression: compressor.noCompression,
-	}
-	if _, err := header.WriteTo(&compressor.outBuf); err != nil {
+	if _, err := compressor.header.WriteTo(&compressor.outBuf); err != nil {
 		panic(err)
 	}
+	compressor.resetState()
+}
+
+// ResetKeepHeader is the same as Reset, but keeps the header already at the beginning of the output instead of
+// serializing it again, which saves allocations when the compressor is reset very often, e.g. to estimate compressed sizes.
+func (compressor *Compressor) ResetKeepHeader() {
+	if compressor.noCompression {
+		// the output starts with a different header
+		compressor.Reset()
+		return
+	}
+	compressor.flushBitWriter()
+	compressor.outBuf.Truncate(compressor.header.size())
+	compressor.resetState()
+}
+
+// flushBitWriter empties the bit writer cache into the output, which a failed Write may have left non-empty.
+// The output must be reset afterwards.
+func (compressor *Compressor) flushBitWriter() {
+	if _, err := compressor.bw.Align(); err != nil {
+		panic(err) // writing to a bytes.Buffer cannot fail
+	}
+}
+
+// resetState resets everything but the output, which must only consist of the header
+func (compressor *Compressor) resetState() {
+	compressor.checkpoints = compressor.checkpoints[:0]
+	compressor.generation++
+	compressor.noCompression = false
 	compressor.inBuf.Reset()
 	compressor.lastOutLen = compressor.outBuf.Len()
 	compressor.lastNbSkippedBits = 0
 	compressor.nbSkippedBits = 0
 	compressor.lastInLen = 0
+	compressor.stats = writeStats{}
+	compressor.lastStats = writeStats{}
 }
 
 // Len returns the number of bytes compressed so far (includes the header)
@@ -319,20 +707,76 @@ func (compressor *Compressor) WrittenBytes() []byte {
 	return compressor.inBuf.Bytes()
 }
 
+// WriteUpTo writes the longest prefix of d that keeps the compressed data within maxOutLen bytes, and returns its length.
+// Compression is bypassed if that is what makes the prefix fit. A subsequent Revert undoes the whole call, as it would a Write.
+// The prefix is found by binary search, each step writing and reverting a candidate prefix, so this is slow: on a
+// 600KB block it takes about twice as long as a Write of the whole block, i.e. around half a second. Compressed sizes are only roughly monotonic in the input, so a longer prefix than the one returned
+// might also happen to fit.
+func (compressor *Compressor) WriteUpTo(d []byte, maxOutLen int) (consumed int, err error) {
+	d = d[:max(0, min(len(d), compressor.maxInputSize-compressor.inBuf.Len()))]
+
+	fits := func(n int) (bool, error) {
+		if compressor.noCompression {
+			return compressor.Len()+n <= maxOutLen, nil
+		}
+		if _, err := compressor.Write(d[:n]); err != nil {
+			return false, err
+		}
+		ok := compressor.Len() <= maxOutLen || HeaderSize+compressor.inBuf.Len() <= maxOutLen
+		return ok, compressor.Revert()
+	}
+
+	// find n such that d[:n] fits but d[:n+1] does not
+	n := len(d)
+	if ok, err := fits(n); err != nil {
+		return 0, err
+	} else if !ok {
+		n = 0
+		for hi := len(d); hi-n > 1; {
+			mid := (n + hi) / 2
+			ok, err := fits(mid)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				n = mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+
+	if _, err = compressor.Write(d[:n]); err != nil {
+		return 0, err
+	}
+	if compressor.Len() > maxOutLen && HeaderSize+compressor.inBuf.Len() <= maxOutLen {
+		compressor.bypass()
+	}
+	return n, nil
+}
+
 // Revert undoes the last call to Write
 // between any two calls to Revert, a call to Reset or Write should be made
 func (compressor *Compressor) Revert() error {
 	if compressor.lastInLen == -1 {
 		return fmt.Errorf("cannot revert twice in a row")
 	}
+	if compressor.lastInLen == compressor.inBuf.Len() {
+		// the last write was empty; in particular, a bypassed compressor must not recompress its input
+		compressor.lastInLen = -1
+		return nil
+	}
 
 	compressor.inBuf.Truncate(compressor.lastInLen)
 	compressor.lastInLen = -1
 
+	// drop the checkpoints taken after the write
+	for len(compressor.checkpoints) != 0 && compressor.checkpoints[len(compressor.checkpoints)-1].inLen > compressor.inBuf.Len() {
+		compressor.checkpoints = compressor.checkpoints[:len(compressor.checkpoints)-1]
+	}
+
 	if compressor.noCompression {
-		in := compressor.inBuf.Bytes()
-		compressor.Reset()
-		if _, err := compressor.Write(in); err != nil { // recompress everything. inefficient but 1) gets a better compression ratio and 2) this is not a common case
+		if err := compressor.recompress(compressor.inBuf.Len()); err != nil { // inefficient but 1) gets a better compression ratio and 2) this is not a common case
 			return err
 		}
 		compressor.ConsiderBypassing()
@@ -340,37 +784,170 @@ func (compressor *Compressor) Revert() error {
 	} else {
 		compressor.outBuf.Truncate(compressor.lastOutLen)
 		compressor.nbSkippedBits = compressor.lastNbSkippedBits
+		compressor.clearPadding()
+		compressor.stats = compressor.lastStats
 		return nil
 	}
 }
 
+// recompress compresses the first inLen bytes of the input from scratch, in a single Write, keeping the checkpoints.
+func (compressor *Compressor) recompress(inLen int) error {
+	in := compressor.inBuf.Bytes()[:inLen]
+	checkpoints := compressor.checkpoints
+	compressor.Reset()
+	compressor.checkpoints = checkpoints
+	_, err := compressor.Write(in)
+	return err
+}
+
+// checkpoint records the state of the compressor, see Checkpoint
+type checkpoint struct {
+	inLen, outLen int
+	nbSkippedBits uint8
+	stats         writeStats
+	noCompression bool
+	generation    int
+}
+
+// Checkpoint records the current state of the compressor, and returns a token to pass to RevertTo in order to get back to it.
+// The token, and those of the checkpoints taken before, remain valid until the compressor is Reset
+// or the data written before the checkpoint is reverted.
+func (compressor *Compressor) Checkpoint() int {
+	compressor.checkpoints = append(compressor.checkpoints, checkpoint{
+		inLen:         compressor.inBuf.Len(),
+		outLen:        compressor.outBuf.Len(),
+		nbSkippedBits: compressor.nbSkippedBits,
+		stats:         compressor.stats,
+		noCompression: compressor.noCompression,
+		generation:    compressor.generation,
+	})
+	return len(compressor.checkpoints) - 1
+}
+
+// RevertTo undoes all the writes made since the given checkpoint was taken, and discards the checkpoints taken after it.
+// If compression was bypassed in between, the input up to the checkpoint is compressed again from scratch,
+// so the output may differ from the one at the time of the checkpoint, while decompressing to the same data.
+// Revert cannot be called right after RevertTo.
+func (compressor *Compressor) RevertTo(token int) error {
+	if token < 0 || token >= len(compressor.checkpoints) {
+		return fmt.Errorf("invalid checkpoint %d", token)
+	}
+	cp := compressor.checkpoints[token]
+	compressor.checkpoints = compressor.checkpoints[:token+1]
+	compressor.lastInLen = -1
+
+	if cp.generation != compressor.generation {
+		// the output was rebuilt since the checkpoint
+		if err := compressor.recompress(cp.inLen); err != nil {
+			return err
+		}
+		if cp.noCompression {
+			compressor.bypass()
+		}
+		compressor.lastInLen = -1
+		return nil
+	}
+
+	compressor.inBuf.Truncate(cp.inLen)
+	compressor.outBuf.Truncate(cp.outLen)
+	compressor.nbSkippedBits = cp.nbSkippedBits
+	compressor.clearPadding()
+	compressor.stats = cp.stats
+	return nil
+}
+
+// clearPadding zeroes the unused bits of the last output byte, which later writes may have used before being reverted
+func (compressor *Compressor) clearPadding() {
+	out := compressor.outBuf.Bytes()
+	out[len(out)-1] &^= byte(1)<<compressor.nbSkippedBits - 1
+}
+
 // ConsiderBypassing switches to NoCompression if we get significant expansion instead of compression
 func (compressor *Compressor) ConsiderBypassing() (bypassed bool) {
+	return compressor.ConsiderBypassingWithThreshold(1)
+}
 
-	if compressor.outBuf.Len() > compressor.inBuf.Len()+HeaderSize {
+// ConsiderBypassingWithThreshold switches to NoCompression if the compressed data is more than maxRatio times
+// the size it would have with compression bypassed. ConsiderBypassing uses a maxRatio of 1;
+// a larger one tolerates some expansion, while a smaller one also bypasses marginal compression.
+func (compressor *Compressor) ConsiderBypassingWithThreshold(maxRatio float64) (bypassed bool) {
+	if compressor.noCompression {
+		return false
+	}
+	if float64(compressor.outBuf.Len()) > maxRatio*float64(compressor.inBuf.Len()+HeaderSize) {
 		// compression was not worth it
-		compressor.noCompression = true
-		compressor.nbSkippedBits = 0
-		compressor.lastOutLen = compressor.lastInLen + HeaderSize
-		compressor.lastNbSkippedBits = 0
-		compressor.outBuf.Reset()
-		header := Header{Version: Version, NoCompression: compressor.noCompression}
-		if _, err := header.WriteTo(&compressor.outBuf); err != nil {
-			panic(err)
-		}
-		if _, err := compressor.outBuf.Write(compressor.inBuf.Bytes()); err != nil {
-			panic(err)
-		}
+		compressor.bypass()
 		return true
 	}
 	return false
 }
 
+// bypass switches to NoCompression, replacing the output with a copy of the input
+func (compressor *Compressor) bypass() {
+	compressor.generation++
+	compressor.noCompression = true
+	compressor.nbSkippedBits = 0
+	compressor.lastOutLen = compressor.lastInLen + HeaderSize
+	compressor.lastNbSkippedBits = 0
+	compressor.stats = writeStats{} // the output no longer contains any compressed data
+	compressor.outBuf.Reset()
+	header := Header{Version: Version, NoCompression: compressor.noCompression}
+	if _, err := header.WriteTo(&compressor.outBuf); err != nil {
+		panic(err)
+	}
+	if _, err := compressor.outBuf.Write(compressor.inBuf.Bytes()); err != nil {
+		panic(err)
+	}
+}
+
+// RLEStats returns how many times the RLE fast path was taken to produce the current compressed data,
+// and how many input bytes it covered in total.
+func (compressor *Compressor) RLEStats() (invocations, bytesCovered int) {
+	return compressor.stats.rleInvocations, compressor.stats.rleBytes
+}
+
+// LiteralHistogram returns, for each byte value, the number of times it was emitted as a literal
+// (i.e. not covered by a backref) in the current compressed data.
+func (compressor *Compressor) LiteralHistogram() [256]int {
+	return compressor.stats.literals
+}
+
+// Stats returns statistics about the emissions making up the current compressed data.
+// They are all zero if compression was bypassed.
+func (compressor *Compressor) Stats() CompressionStats {
+	s := CompressionStats{
+		RawBytes:       compressor.stats.rawBytes,
+		ShortLengths:   compressor.stats.shortLengths,
+		DynamicLengths: compressor.stats.dynamicLengths,
+		DictLengths:    compressor.stats.dictLengths,
+		MicroLengths:   compressor.stats.microLengths,
+	}
+	for _, n := range compressor.stats.literals {
+		s.Literals += n
+	}
+	for i := range s.ShortLengths {
+		s.ShortBackrefs += s.ShortLengths[i]
+		s.DynamicBackrefs += s.DynamicLengths[i]
+		s.DictBackrefs += s.DictLengths[i]
+	}
+	for _, n := range s.MicroLengths {
+		s.MicroBackrefs += n
+	}
+	return s
+}
+
 // Bytes returns the compressed data
+// The unused bits of the last byte, if any, are always zero.
 func (compressor *Compressor) Bytes() []byte {
 	return compressor.outBuf.Bytes()
 }
 
+// Checksum returns the digest under h of the compressed data, as returned by Bytes. h is reset before use.
+// The digest can be stored alongside the compressed data, and checked upon decompression with DecompressVerify.
+func (compressor *Compressor) Checksum(h hash.Hash) []byte {
+	return checksum(h, compressor.Bytes())
+}
+
 // Compress compresses the given data and returns the compressed data
 func (compressor *Compressor) Compress(d []byte) (c []byte, err error) {
 	compressor.Reset()
@@ -378,32 +955,219 @@ func (compressor *Compressor) Compress(d []byte) (c []byte, err error) {
 	return compressor.Bytes(), err
 }
 
+// ctxCheckInterval is the number of input bytes compressed between two checks of the context passed to CompressCtx
+const ctxCheckInterval = 1 << 12
+
+// CompressCtx is the same as Compress, but gives up and returns ctx.Err() soon after ctx is done.
+// The compressor must then be Reset before writing again.
+func (compressor *Compressor) CompressCtx(ctx context.Context, d []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	compressor.ctx = ctx
+	defer func() { compressor.ctx = nil }()
+	c, err := compressor.Compress(d)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CompressStateless returns the same as Compress, but leaves the compressor untouched and allocates its own scratch space.
+// Only the dictionary index is shared, so it can be called from many goroutines at once (but other methods cannot),
+// unless a decision trace is set.
+func (compressor *Compressor) CompressStateless(d []byte) ([]byte, error) {
+	if len(d) > compressor.maxInputSize {
+		return nil, fmt.Errorf("input size must be <= %d", compressor.maxInputSize)
+	}
+
+	var out bytes.Buffer
+	out.Grow(compressor.header.size() + len(d))
+	if _, err := compressor.header.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	if len(d) == 0 {
+		return out.Bytes(), nil
+	}
+
+	bw := bitio.NewWriter(&out)
+	index := suffixarray.New(d, make([]int32, len(d)))
+	if _, err := compressor.write(bw, d, 0, index, 0, nil); errors.Is(err, errOutOfReach) {
+		// bypass compression, as Write does
+		out.Reset()
+		header := Header{Version: Version, NoCompression: true}
+		if _, err = header.WriteTo(&out); err != nil {
+			return nil, err
+		}
+		out.Write(d)
+		return out.Bytes(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if bw.TryError != nil {
+		return nil, bw.TryError
+	}
+	if _, err := bw.Align(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
 // CompressedSize256k returns the size of the compressed data
 // This is state less and thread-safe (but other methods are not)
-// Max size of d is 256kB
+// Max size of d is 256kB, or the compressor's max input size if smaller
 func (compressor *Compressor) CompressedSize256k(d []byte) (size int, err error) {
-	size = HeaderSize
-	if compressor.noCompression {
-		size += len(d)
-		return
+	if limit := min(maxInputSize256k, compressor.maxInputSize); len(d) > limit {
+		return 0, fmt.Errorf("input size must be <= %d", limit)
 	}
-	const maxInputSize = 1 << 18 // 256kB
-	if len(d) > maxInputSize {
-		return 0, fmt.Errorf("input size must be <= %d", maxInputSize)
+	if compressor.noCompression {
+		return HeaderSize + len(d), nil
 	}
 
 	// build the index
-	var indexSpace [maxInputSize]int32 // should be allocated on the stack.
+	var indexSpace [maxInputSize256k]int32 // should be allocated on the stack.
 	index := suffixarray.New(d, indexSpace[:len(d)])
 
+	return compressor.compressedSize(d, index)
+}
+
+const maxInputSize256k = 1 << 18 // 256kB
+
+// CompressedSize returns the size of the compressed data
+// Like CompressedSize256k, this is state less and thread-safe, but accepts inputs up to the compressor's max input size.
+// Inputs of at most 256kB are handled by CompressedSize256k, which avoids allocating index space on the heap.
+func (compressor *Compressor) CompressedSize(d []byte) (size int, err error) {
+	if len(d) <= maxInputSize256k {
+		return compressor.CompressedSize256k(d)
+	}
+	if len(d) > compressor.maxInputSize {
+		return 0, fmt.Errorf("input size must be <= %d", compressor.maxInputSize)
+	}
+	if compressor.noCompression {
+		return HeaderSize + len(d), nil
+	}
+
+	index := suffixarray.New(d, make([]int32, len(d)))
+	return compressor.compressedSize(d, index)
+}
+
+// compressedSize returns the size of the compressed data, given the index of d
+func (compressor *Compressor) compressedSize(d []byte, index *suffixarray.Index) (size int, err error) {
 	bw := &bitCounterWriter{}
-	_, err = compressor.write(bw, d, 0, index)
-	if err != nil {
+	if _, err = compressor.write(bw, d, 0, index, 0, nil); errors.Is(err, errOutOfReach) {
+		return HeaderSize + len(d), nil // compression is bypassed, as Write does
+	} else if err != nil {
 		return
 	}
+	return compressor.header.size() + bw.Len(), nil
+}
 
-	size += bw.Len()
-	return
+// DictSavingsBits compresses d, without modifying the state of the compressor, and returns the number of bits saved
+// by backrefs into the dictionary over writing their content as literals. It gives a single number to compare
+// candidate dictionaries by. Reserved symbols can only be taken from the dictionary or the input, so the backrefs
+// of length 1 they require can make it negative.
+func (compressor *Compressor) DictSavingsBits(d []byte) (int, error) {
+	if len(d) > compressor.maxInputSize {
+		return 0, fmt.Errorf("input size must be <= %d", compressor.maxInputSize)
+	}
+	if len(d) == 0 {
+		return 0, nil
+	}
+
+	var stats writeStats
+	index := suffixarray.New(d, make([]int32, len(d)))
+	if _, err := compressor.write(&bitCounterWriter{}, d, 0, index, 0, &stats); err != nil {
+		return 0, err
+	}
+	return stats.dictSavings, nil
+}
+
+// EstimateCompressedBits returns the exact size in bits of the compressed data that a compressor with the given dictionary
+// and options would produce for d, without compression being bypassed, padding to the next byte excluded.
+// It fails if d holds a reserved symbol that no backref can reach, in which case the compressor would have to bypass compression.
+// Unlike creating a compressor and calling CompressedSize, it only allocates the indexes of the dictionary and of d,
+// and none of the compressor's input and output buffers.
+func EstimateCompressedBits(dict, d []byte, opts ...Option) (int, error) {
+	if len(d) > MaxInputSize {
+		return 0, fmt.Errorf("input size must be <= %d", MaxInputSize)
+	}
+	settings := newCompressorSettings(opts)
+	if err := settings.check(); err != nil {
+		return 0, err
+	}
+	header := settings.header()
+	dict = augmentDict(dict, header.reservedSymbols()...)
+	if len(dict) > MaxDictSize {
+		return 0, fmt.Errorf("dict size must be <= %d", MaxDictSize)
+	}
+	compressor := Compressor{
+		dictData:  dict,
+		dictIndex: suffixarray.New(dict, make([]int32, len(dict))),
+		settings:  settings,
+		header:    header,
+	}
+	if settings.dictFingerprint {
+		compressor.header.HasDictFingerprint = true // only the size of the header matters
+	}
+
+	bw := &bitCounterWriter{}
+	if _, err := compressor.write(bw, d, 0, suffixarray.New(d, make([]int32, len(d))), 0, nil); err != nil {
+		return 0, err
+	}
+	return 8*compressor.header.size() + bw.nbBits, nil
+}
+
+// ReservedSymbol gives the positions at which a symbol reserved by the format appears in an augmented dictionary.
+// Positions at or beyond the length of the caller's dictionary are those of symbols appended by the augmentation.
+type ReservedSymbol struct {
+	Symbol    byte
+	Positions []int
+
+	// Reach is the largest index in the input at which the symbol can be encoded by a backref to its last occurrence
+	// in the dictionary, or -1 if it is out of reach from the start. The dictionary only gets further away as the input
+	// grows, so past Reach the symbol must also occur in the preceding 2MB of input, or compression is bypassed.
+	Reach int
+}
+
+// ValidateDictionary reports the issues that would prevent the dictionary from being used for compression with the
+// given options, once augmented: it must not exceed MaxDictSize, and the last occurrence of each symbol the options
+// reserve must be within reach of dynamic backrefs, since these symbols can only be encoded as references.
+// A dictionary missing the reserved symbols altogether is valid; they are appended at the end.
+// A nil error only means that the reserved symbols can be encoded at the beginning of the input; no dictionary keeps them
+// within reach of inputs longer than 2MB. See ReservedSymbol.Reach for how far each of them can be.
+// Whether or not the dictionary is valid, the positions of the reserved symbols are returned, in the order of
+// the symbols, unless the options themselves are invalid.
+func ValidateDictionary(dict []byte, opts ...Option) ([]ReservedSymbol, error) {
+	settings := newCompressorSettings(opts)
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	header := settings.header()
+	dict = augmentDict(dict, header.reservedSymbols()...)
+
+	var errs []error
+	if len(dict) > MaxDictSize {
+		errs = append(errs, fmt.Errorf("augmented dictionary is %d bytes long; it must be <= %d", len(dict), MaxDictSize))
+	}
+
+	// the addresses are the widest past the beginning of the input, even with adaptive addresses
+	maxAddress := header.dynamicBackrefType(len(dict), MaxInputSize).maxAddress
+	symbols := make([]ReservedSymbol, 0, len(header.reservedSymbols()))
+	for _, s := range header.reservedSymbols() {
+		symbol := ReservedSymbol{Symbol: s}
+		for i, b := range dict {
+			if b == s {
+				symbol.Positions = append(symbol.Positions, i)
+			}
+		}
+		i := symbol.Positions[len(symbol.Positions)-1]
+		symbol.Reach = max(-1, maxAddress-(len(dict)-i))
+		symbols = append(symbols, symbol)
+		if symbol.Reach < 0 {
+			errs = append(errs, fmt.Errorf("reserved symbol 0x%x last appears at offset %d; it must be within the last %d bytes of the dictionary", s, i, maxAddress))
+		}
+	}
+	return symbols, errors.Join(errs...)
 }
 
 type bitCounterWriter struct {
@@ -424,15 +1188,48 @@ func (b *bitCounterWriter) Len() int {
 	return (b.nbBits + 7) / 8
 }
 
+// errOutOfReach is wrapped by the errors of errSymbolOutOfReach
+var errOutOfReach = errors.New("out of reach of any backref")
+
+// errSymbolOutOfReach is returned when a reserved symbol occurs neither in the window nor in the addressable part of the dictionary.
+// The input can then only be stored with compression bypassed.
+func errSymbolOutOfReach(b byte, i int) error {
+	return fmt.Errorf("reserved symbol %#x at index %d is %w", b, i, errOutOfReach)
+}
+
 // canEncodeSymbol returns true if the symbol can be encoded directly
-func canEncodeSymbol(b byte) bool {
-	return b != SymbolDynamic && b != SymbolShort
+func (compressor *Compressor) canEncodeSymbol(b byte) bool {
+	return !compressor.header.isReserved(b)
+}
+
+// findMicroBackRef is the same as findBackRef for micro backrefs.
+// Their window is small enough that a linear scan beats an index lookup, which would go through every occurrence
+// of the first two bytes in the input.
+func findMicroBackRef(data []byte, i int, bType BackrefType) (addr, length int) {
+	addr, length = -1, -1
+	maxLength := min(bType.maxLength, len(data)-i)
+	for j := max(0, i-bType.maxAddress); j < i; j++ {
+		l := 0
+		for l < maxLength && data[j+l] == data[i+l] {
+			l++
+		}
+		if l >= bType.nbBytesBackRef && l > length {
+			addr, length = j, l
+		}
+	}
+	return
+}
+
+// dynamicBackrefType returns the type of dynamic backrefs at position i of the input
+func (compressor *Compressor) dynamicBackrefType(i int) BackrefType {
+	return compressor.header.dynamicBackrefType(len(compressor.dictData), i)
 }
 
 // findBackRef attempts to find a backref in the window [i-brAddressRange, i+brLengthRange]
 // if no backref is found, it returns -1, -1
 // else returns the address and length of the backref
-func findBackRef(data []byte, i int, bType BackrefType, minLength int, dataIndex, dictIndex *suffixarray.Index, dictLen int) (addr, length int) {
+// dataIndex indexes data[dataIndexStart:]; the window must not start before dataIndexStart.
+func findBackRef(data []byte, i int, bType BackrefType, minLength int, dataIndex *suffixarray.Index, dataIndexStart int, dictIndex *suffixarray.Index, dictLen int) (addr, length int) {
 	if minLength == -1 {
 		minLength = bType.nbBytesBackRef
 	}
@@ -442,7 +1239,7 @@ func findBackRef(data []byte, i int, bType BackrefType, minLength int, dataIndex
 	}
 
 	windowStart := max(0, i-bType.maxAddress)
-	maxLength := 1 << maxBackrefLenLog2
+	maxLength := bType.maxLength
 	if i+maxLength > len(data) {
 		maxLength = len(data) - i
 	}
@@ -452,15 +1249,20 @@ func findBackRef(data []byte, i int, bType BackrefType, minLength int, dataIndex
 	}
 
 	// we look for data[i:i+maxLength) in the window data[windowStart:i)
-	addr, length = dataIndex.LookupLongest(data[i:i+maxLength], minLength, maxLength, windowStart, i)
+	addr, length = dataIndex.LookupLongest(data[i:i+maxLength], minLength, maxLength, windowStart-dataIndexStart, i-dataIndexStart)
+	if length != -1 {
+		addr += dataIndexStart
+	}
 	if bType.Delimiter == SymbolDynamic {
 		addr += dictLen
 	}
 
 	if length < maxLength && bType.Delimiter == SymbolDynamic {
 		// we also check the dictionary and check if it's a better backref
-		// we look for data[i:i+maxLength) in the dict[0:DictLen)
-		dAddr, dLength := dictIndex.LookupLongest(data[i:i+maxLength], minLength, maxLength, 0, dictLen)
+		// we look for data[i:i+maxLength) in the dict[dictStart:DictLen)
+		// the dictionary sits right before the input in the address space, so only its tail may be within reach
+		dictStart := max(0, i+dictLen-bType.maxAddress)
+		dAddr, dLength := dictIndex.LookupLongest(data[i:i+maxLength], minLength, maxLength, dictStart, dictLen)
 		if dLength > length {
 			addr, length = dAddr, dLength
 		}
@@ -470,8 +1272,8 @@ func findBackRef(data []byte, i int, bType BackrefType, minLength int, dataIndex
 }
 
 func (compressor *Compressor) appendInput(d []byte) error {
-	if compressor.inBuf.Len()+len(d) > MaxInputSize {
-		return fmt.Errorf("input size must be <= %d", MaxInputSize)
+	if compressor.inBuf.Len()+len(d) > compressor.maxInputSize {
+		return fmt.Errorf("input size must be <= %d", compressor.maxInputSize)
 	}
 	compressor.lastInLen = compressor.inBuf.Len()
 	compressor.inBuf.Write(d)
@@ -484,3 +1286,10 @@ func max(a, b int) int {
 	}
 	return b
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
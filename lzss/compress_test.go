@@ -1,10 +1,19 @@
+//go:build !decompressonly
+
 package lzss
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/icza/bitio"
@@ -213,6 +222,13 @@ func FuzzCompressedSize(f *testing.F) {
 			t.Fatal("CompressedSize256k returned wrong size")
 		}
 
+		if n, err = compressor.CompressedSize(input); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(compressed) {
+			t.Fatal("CompressedSize returned wrong size")
+		}
+
 	})
 
 }
@@ -306,14 +322,6 @@ func compresslzss_v1(compressor *Compressor, data []byte) (compressResult, error
 	}, nil
 }
 
-func getDictionary() []byte {
-	d, err := os.ReadFile("./testdata/dict_naive")
-	if err != nil {
-		panic(err)
-	}
-	return d
-}
-
 func TestRevert(t *testing.T) {
 	assert := require.New(t)
 
@@ -588,9 +596,1444 @@ func BenchmarkCompressedSize(b *testing.B) {
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// BenchmarkChunkedWrite measures a 1KB Write into a compressor already holding megabytes of input
+func BenchmarkChunkedWrite(b *testing.B) {
+	var data []byte
+	for _, name := range []string{"1-1865800", "1-goerli-3690632", "2-1865938", "3-1866069", "5-1128897"} {
+		d, err := os.ReadFile("./testdata/blobs/" + name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data = append(data, d...)
+	}
+	const chunkSize = 1 << 10
+
+	for _, inputSize := range []int{1 << 20, 5 << 19} {
+		b.Run(fmt.Sprintf("%dKB", inputSize>>10), func(b *testing.B) {
+			compressor, err := NewCompressor(getDictionary())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err = compressor.Write(data[:inputSize]); err != nil {
+				b.Fatal(err)
+			}
+			chunk := data[inputSize : inputSize+chunkSize]
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = compressor.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+				if err = compressor.Revert(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionTrace(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = append(d, make([]byte, 300)...) // exercise the RLE path as well
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	var decisions []Decision
+	covered := 0
+	compressor.SetDecisionTrace(func(pos int, decision Decision) {
+		assert.Equal(covered, pos, "decisions must be reported in order")
+		covered += decision.Length
+		decisions = append(decisions, decision)
+	})
+
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	assert.Equal(len(d), covered)
+
+	// every literal and backref in the stream must correspond to a decision
+	phrases, err := CompressedStreamInfo(c, dict)
+	assert.NoError(err)
+	nbEmissions := 0
+	for _, phrase := range phrases {
+		if phrase.Type == 0 {
+			nbEmissions += phrase.Length
+		} else {
+			nbEmissions++
+		}
+	}
+	assert.Equal(nbEmissions, len(decisions))
+
+	for _, decision := range decisions {
+		switch decision.Type {
+		case 0:
+			assert.Equal(1, decision.Length)
+		case SymbolShort:
+			assert.False(decision.FromDict)
+			assert.Greater(decision.ShortSavings, math.MinInt)
+		case SymbolDynamic:
+			assert.Greater(decision.DynamicSavings, math.MinInt)
+		default:
+			t.Fatalf("unexpected decision type %x", decision.Type)
+		}
+	}
+}
+
+func TestWithoutRLE(t *testing.T) {
+	assert := require.New(t)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict, WithoutRLE())
+	assert.NoError(err)
+
+	d := append([]byte{'h', 'i'}, make([]byte, 1000)...)
+	d = append(d, bytes.Repeat([]byte{SymbolShort}, 300)...)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	invocations, _ := compressor.RLEStats()
+	assert.Zero(invocations)
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+func TestRLEStats(t *testing.T) {
+	assert := require.New(t)
+
+	compressor, err := NewCompressor(getDictionary())
+	assert.NoError(err)
+
+	// a long run should take the RLE path
+	d := append([]byte{'h', 'i'}, make([]byte, 1000)...)
+	_, err = compressor.Compress(d)
+	assert.NoError(err)
+	invocations, bytesCovered := compressor.RLEStats()
+	assert.Greater(invocations, 0)
+	assert.Equal(1000, bytesCovered)
+
+	// reverting the write reverts the stats
+	_, err = compressor.Write(make([]byte, 500))
+	assert.NoError(err)
+	_, bytesCovered = compressor.RLEStats()
+	assert.Equal(1500, bytesCovered)
+	assert.NoError(compressor.Revert())
+	_, bytesCovered = compressor.RLEStats()
+	assert.Equal(1000, bytesCovered)
+
+	// run-free input should never take the RLE path
+	d, err = os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	for i := 1; i < len(d); i++ {
+		if d[i] == d[i-1] {
+			d[i]++
+		}
+	}
+	_, err = compressor.Compress(d)
+	assert.NoError(err)
+	invocations, bytesCovered = compressor.RLEStats()
+	assert.Equal(0, invocations)
+	assert.Equal(0, bytesCovered)
+}
+
+func TestEmptyWrite(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:2000]
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	n, err := compressor.Write(nil)
+	assert.NoError(err)
+	assert.Equal(0, n)
+	assert.Equal(HeaderSize, compressor.Len())
+
+	_, err = compressor.Write(d[:1000])
+	assert.NoError(err)
+	lenBefore := compressor.Len()
+
+	n, err = compressor.Write([]byte{})
+	assert.NoError(err)
+	assert.Equal(0, n)
+	assert.Equal(lenBefore, compressor.Len())
+
+	// reverting an empty write does not undo the previous one
+	assert.NoError(compressor.Revert())
+	assert.Equal(lenBefore, compressor.Len())
+	assert.Equal(1000, compressor.Written())
+
+	_, err = compressor.Write(d[1000:])
+	assert.NoError(err)
+	_, err = compressor.Write(nil)
+	assert.NoError(err)
+
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// the result must not depend on the empty writes
+	c, err := compressor.Compress(d[:1000])
+	assert.NoError(err)
+	cWithoutEmpty := bytes.Clone(c)
+	compressor.Reset()
+	_, err = compressor.Write(nil)
+	assert.NoError(err)
+	_, err = compressor.Write(d[:1000])
+	assert.NoError(err)
+	assert.Equal(cWithoutEmpty, compressor.Bytes())
+
+	// nor is it undone by a bypassed compressor, which would otherwise recompress its input
+	assert.True(compressor.ConsiderBypassingWithThreshold(0.1))
+	c = bytes.Clone(compressor.Bytes())
+	_, err = compressor.Write(nil)
+	assert.NoError(err)
+	assert.NoError(compressor.Revert())
+	assert.Equal(c, compressor.Bytes())
+	assert.Error(compressor.Revert())
+}
+
+// TestDictBoundary exercises backrefs on both sides of the boundary between the dictionary and the window
+func TestDictBoundary(t *testing.T) {
+	dicts := [][]byte{
+		append([]byte{1, 2, 3}, make([]byte, 200)...),
+		append([]byte{SymbolShort, SymbolDynamic, 1}, make([]byte, 200)...),
+		append(append([]byte{SymbolShort, SymbolDynamic}, make([]byte, 200)...), 0xFF, 0xFF, 0xFF),
+		make([]byte, 300),
+	}
+	inputs := [][]byte{
+		make([]byte, 10),
+		make([]byte, 199),
+		make([]byte, 200),
+		make([]byte, 201),
+		make([]byte, 500),
+		append(make([]byte, 150), 1, 2, 3),
+		append([]byte{SymbolDynamic, SymbolDynamic, SymbolShort}, make([]byte, 300)...),
+		bytes.Repeat([]byte{SymbolDynamic}, 300),
+	}
+
+	for _, dict := range dicts {
+		for _, d := range inputs {
+			compressor, err := NewCompressor(dict)
+			require.NoError(t, err)
+			c, err := compressor.Compress(d)
+			require.NoError(t, err)
+			dBack, err := Decompress(c, dict)
+			require.NoError(t, err)
+			require.Equal(t, d, dBack)
+		}
+	}
+}
+
+func TestLargeDictAddressRange(t *testing.T) {
+	assert := require.New(t)
+
+	// the dynamic backrefs can't reach the beginning of a dictionary this large
+	dict := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(dict) //#nosec G404 weak rng is fine here
+	dict[0] = SymbolDynamic
+
+	d := append(bytes.Clone(dict[:100]), dict[len(dict)-100:]...)
+	d = append(d, make([]byte, 300)...)
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+// TestSymbolOutOfReach checks that input holding a reserved symbol no backref can reach is stored with compression bypassed
+func TestSymbolOutOfReach(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large input test in short mode")
+	}
+	assert := require.New(t)
+
+	d := make([]byte, 5<<19)
+	rng := rand.New(rand.NewSource(0)) //#nosec G404 weak rng is fine here
+	for i := range d {
+		d[i] = byte(rng.Intn(int(SymbolShort)))
+	}
+	d = append(d, SymbolDynamic)
+
+	compressor, err := NewCompressor(nil)
+	assert.NoError(err)
+	_, err = compressor.Write(d[:1000])
+	assert.NoError(err)
+	c1000 := bytes.Clone(compressor.Bytes())
+	n, err := compressor.Write(d[1000:])
+	assert.NoError(err)
+	assert.Equal(len(d)-1000, n)
+	c := bytes.Clone(compressor.Bytes())
+	assert.Equal(HeaderSize+len(d), len(c))
+	dBack, err := Decompress(c, nil)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// the stateless paths agree
+	cStateless, err := compressor.CompressStateless(d)
+	assert.NoError(err)
+	assert.Equal(c, cStateless)
+	size, err := compressor.CompressedSize(d)
+	assert.NoError(err)
+	assert.Equal(len(c), size)
+	_, err = EstimateCompressedBits(nil, d)
+	assert.Error(err)
+
+	// reverting the write compresses the rest of the input again
+	assert.NoError(compressor.Revert())
+	assert.Equal(c1000, compressor.Bytes())
+}
+
+func TestLiteralHistogram(t *testing.T) {
+	assert := require.New(t)
+
+	compressor, err := NewCompressor(nil)
+	assert.NoError(err)
+
+	// no repetitions, so everything is a literal
+	d := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 2, 4, 6, 8}
+	_, err = compressor.Compress(d)
+	assert.NoError(err)
+
+	var expected [256]int
+	for _, b := range d {
+		expected[b]++
+	}
+	assert.Equal(expected, compressor.LiteralHistogram())
+
+	// a long run is a single literal followed by a backref
+	_, err = compressor.Compress(append([]byte{'a'}, bytes.Repeat([]byte{'b'}, 200)...))
+	assert.NoError(err)
+	expected = [256]int{}
+	expected['a'] = 1
+	expected['b'] = 1
+	assert.Equal(expected, compressor.LiteralHistogram())
+
+	// reserved symbols are never literals
+	_, err = compressor.Compress([]byte{SymbolShort, SymbolDynamic, 0})
+	assert.NoError(err)
+	expected = [256]int{}
+	expected[0] = 1
+	assert.Equal(expected, compressor.LiteralHistogram())
+}
+
+// TestPaddingBitsDeterministic pins that the unused bits of the last byte are always zero
+func TestPaddingBitsDeterministic(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	for _, size := range []int{1, 2, 3, 100, 1000, 10000} {
+		c1, err := compressor.Compress(d[:size])
+		assert.NoError(err)
+		c1 = bytes.Clone(c1)
+		nbSkippedBits := compressor.nbSkippedBits
+
+		// dirty the compressor in between
+		_, err = compressor.Compress(d[size : 2*size])
+		assert.NoError(err)
+
+		c2, err := compressor.Compress(d[:size])
+		assert.NoError(err)
+		assert.Equal(c1, c2)
+
+		mask := byte(1)<<nbSkippedBits - 1
+		assert.Zero(c1[len(c1)-1]&mask, "padding bits must be zero")
+
+		// reverting a write whose backrefs used the padding bits clears them again
+		compressor.Reset()
+		_, err = compressor.Write(d[:size])
+		assert.NoError(err)
+		_, err = compressor.Write(d[:size])
+		assert.NoError(err)
+		assert.NoError(compressor.Revert())
+		assert.Equal(c1, compressor.Bytes())
+
+		// as does reverting to a checkpoint
+		compressor.Reset()
+		_, err = compressor.Write(d[:size])
+		assert.NoError(err)
+		token := compressor.Checkpoint()
+		for i := 0; i < 3; i++ {
+			_, err = compressor.Write(d[:size])
+			assert.NoError(err)
+		}
+		assert.NoError(compressor.RevertTo(token))
+		assert.Equal(c1, compressor.Bytes())
+	}
+}
+
+func TestCompressorWithLimits(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	_, err = NewCompressorWithLimits(dict, 0)
+	assert.Error(err)
+	_, err = NewCompressorWithLimits(dict, MaxInputSize+1)
+	assert.Error(err)
+
+	const limit = 1000
+	compressor, err := NewCompressorWithLimits(dict, limit)
+	assert.NoError(err)
+
+	c, err := compressor.Compress(d[:limit])
+	assert.NoError(err)
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d[:limit], dBack)
+
+	size, err := compressor.CompressedSize256k(d[:limit])
+	assert.NoError(err)
+	assert.Equal(len(c), size)
+
+	_, err = compressor.Write(d[:1])
+	assert.Error(err, "limit exceeded")
+	_, err = compressor.Compress(d[:limit+1])
+	assert.Error(err)
+	_, err = compressor.CompressedSize256k(d[:limit+1])
+	assert.Error(err)
+}
+
+func TestCompressedSize(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/1-goerli-3690632")
+	assert.NoError(err)
+	assert.Greater(len(d), maxInputSize256k)
+
+	compressor, err := NewCompressor(getDictionary())
+	assert.NoError(err)
+
+	_, err = compressor.CompressedSize256k(d)
+	assert.Error(err)
+
+	size, err := compressor.CompressedSize(d)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	assert.Equal(len(c), size)
+
+	// small inputs take the stack-allocated path
+	size, err = compressor.CompressedSize(d[:1000])
+	assert.NoError(err)
+	c, err = compressor.Compress(d[:1000])
+	assert.NoError(err)
+	assert.Equal(len(c), size)
+
+	_, err = compressor.CompressedSize(make([]byte, MaxInputSize+1))
+	assert.Error(err)
+}
+
+func TestChunkedWriteBeyondWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large input test in short mode")
+	}
+	assert := require.New(t)
+
+	// a block repeated right before it goes out of reach, so that the second copy
+	// is only found if the index covers the whole window
+	rng := rand.New(rand.NewSource(0)) //#nosec G404 weak rng is fine here
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.Intn(int(SymbolShort)))
+		}
+		return b
+	}
+	block := randomBytes(1 << 19)
+	filler := randomBytes(maxWindowSize - len(block) - 1000)
+	d := append(append(append([]byte{}, block...), filler...), block...)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	const chunkSize = 1 << 17
+	for i := 0; i < len(d); i += chunkSize {
+		_, err = compressor.Write(d[i:min(i+chunkSize, len(d))])
+		assert.NoError(err)
+	}
+
+	assert.Less(compressor.Len(), len(block)+len(filler)+len(block)/10)
+
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+func TestStats(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	stats := compressor.Stats()
+
+	// cross-check against the phrases recovered by a decoding pass
+	phrases, err := CompressedStreamInfo(c, dict)
+	assert.NoError(err)
+	var expected CompressionStats
+	augmentedDictLen := len(AugmentDict(dict))
+	for _, p := range phrases {
+		switch {
+		case p.Type == 0:
+			expected.Literals += p.Length
+		case p.Type == SymbolShort:
+			expected.ShortBackrefs++
+			expected.ShortLengths[p.Length-1]++
+		case p.ReferenceAddress < augmentedDictLen:
+			expected.DictBackrefs++
+			expected.DictLengths[p.Length-1]++
+		default:
+			expected.DynamicBackrefs++
+			expected.DynamicLengths[p.Length-1]++
+		}
+	}
+	assert.Equal(expected, stats)
+	assert.NotZero(stats.ShortBackrefs)
+	assert.NotZero(stats.DynamicBackrefs)
+	assert.NotZero(stats.DictBackrefs)
+
+	// stats follow Revert and Reset
+	_, err = compressor.Write(d[:1000])
+	assert.NoError(err)
+	assert.NotEqual(stats, compressor.Stats())
+	assert.NoError(compressor.Revert())
+	assert.Equal(stats, compressor.Stats())
+	compressor.Reset()
+	assert.Equal(CompressionStats{}, compressor.Stats())
+}
+
+func TestLongBackrefs(t *testing.T) {
+	assert := require.New(t)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict, WithLongBackrefs())
+	assert.NoError(err)
+
+	roundTrip := func(d []byte) []byte {
+		c, err := compressor.Compress(d)
+		assert.NoError(err)
+
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		r, err := NewReader(bytes.NewReader(c), dict)
+		assert.NoError(err)
+		dBack, err = io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		phrases, err := CompressedStreamInfo(c, dict)
+		assert.NoError(err)
+		total := 0
+		for _, p := range phrases {
+			total += p.Length
+		}
+		assert.Equal(len(d), total)
+		return c
+	}
+
+	// a 100kB zero run is a literal followed by two backrefs
+	c := roundTrip(make([]byte, 100000))
+	stats := compressor.Stats()
+	assert.Equal(1, stats.Literals)
+	assert.Equal(2, stats.ShortBackrefs+stats.DynamicBackrefs+stats.DictBackrefs)
+	assert.Less(len(c), 16)
+
+	var header Header
+	_, err = header.ReadFrom(bytes.NewReader(c))
+	assert.NoError(err)
+	assert.True(header.LongBackrefs)
+
+	d, err := os.ReadFile("./testdata/blobs/1-goerli-3690632")
+	assert.NoError(err)
+	roundTrip(d)
+}
+
+func TestMicroBackrefs(t *testing.T) {
+	assert := require.New(t)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict, WithMicroBackrefs())
+	assert.NoError(err)
+	plain, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	roundTrip := func(d []byte) []byte {
+		c, err := compressor.Compress(d)
+		assert.NoError(err)
+
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		r, err := NewReader(bytes.NewReader(c), dict)
+		assert.NoError(err)
+		dBack, err = io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		phrases, err := CompressedStreamInfo(c, dict)
+		assert.NoError(err)
+		total := 0
+		for _, p := range phrases {
+			total += p.Length
+		}
+		assert.Equal(len(d), total)
+		return c
+	}
+
+	// too short for a short backref to pay off
+	d := []byte{'h', 'i', 'h', 'i', 'h', 'i'}
+	c := roundTrip(d)
+	cPlain, err := plain.Compress(d)
+	assert.NoError(err)
+	assert.Less(len(c), len(cPlain))
+	assert.Equal(1, compressor.Stats().MicroBackrefs)
+	assert.Equal(1, compressor.Stats().MicroLengths[3])
+
+	// SymbolMicro is reserved
+	roundTrip([]byte{SymbolMicro, 1, SymbolMicro, SymbolShort, SymbolDynamic, SymbolMicro})
+	assert.Zero(compressor.LiteralHistogram()[SymbolMicro])
+
+	data, err := os.ReadFile("./testdata/average_block.hex")
+	assert.NoError(err)
+	data, err = hex.DecodeString(string(data))
+	assert.NoError(err)
+	roundTrip(data)
+	assert.NotZero(compressor.Stats().MicroBackrefs)
+}
+
+// BenchmarkMicroBackrefs reports the compression ratio of average_block.hex with and without micro backrefs
+func TestAdaptiveAddresses(t *testing.T) {
+	assert := require.New(t)
+
+	for _, dict := range [][]byte{nil, getDictionary()} {
+		compressor, err := NewCompressor(dict, WithAdaptiveAddresses())
+		assert.NoError(err)
+		plain, err := NewCompressor(dict)
+		assert.NoError(err)
+
+		roundTrip := func(d []byte) []byte {
+			c, err := compressor.Compress(d)
+			assert.NoError(err)
+
+			dBack, err := Decompress(c, dict)
+			assert.NoError(err)
+			assert.Equal(d, dBack)
+
+			r, err := NewReader(bytes.NewReader(c), dict)
+			assert.NoError(err)
+			dBack, err = io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(d, dBack)
+
+			phrases, err := CompressedStreamInfo(c, dict)
+			assert.NoError(err)
+			total := 0
+			for _, p := range phrases {
+				total += p.Length
+			}
+			assert.Equal(len(d), total)
+			return c
+		}
+
+		// reserved symbols right at the beginning, when the address space is tiny
+		roundTrip([]byte{SymbolShort, SymbolDynamic, SymbolShort, SymbolShort, SymbolShort})
+		roundTrip(bytes.Repeat([]byte{'a'}, 1000))
+
+		d, err := os.ReadFile("./testdata/blobs/1-goerli-3690632")
+		assert.NoError(err)
+		c := roundTrip(d)
+		var header Header
+		_, err = header.ReadFrom(bytes.NewReader(c))
+		assert.NoError(err)
+		assert.True(header.AdaptiveAddresses)
+
+		cPlain, err := plain.Compress(d)
+		assert.NoError(err)
+		assert.Less(len(c), len(cPlain))
+	}
+}
+
+func BenchmarkMicroBackrefs(b *testing.B) {
+	d, err := os.ReadFile("./testdata/average_block.hex")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := hex.DecodeString(string(d))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{{"default", nil}, {"micro", []Option{WithMicroBackrefs()}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			compressor, err := NewCompressor(getDictionary(), bc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var c []byte
+			for i := 0; i < b.N; i++ {
+				if c, err = compressor.Compress(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data))/float64(len(c)), "ratio")
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/average_block.hex")
+	assert.NoError(err)
+	data, err := hex.DecodeString(string(d))
+	assert.NoError(err)
+	data = data[:20000]
+	dict := getDictionary()
+
+	const chunkSize = 1000
+	writeChunks := func(compressor *Compressor, from, to int) {
+		for i := from; i < to; i += chunkSize {
+			_, err := compressor.Write(data[i : i+chunkSize])
+			assert.NoError(err)
+		}
+	}
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	reference, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	var tokens []int
+	for i := 0; i < 10; i++ {
+		tokens = append(tokens, compressor.Checkpoint())
+		writeChunks(compressor, i*chunkSize, (i+1)*chunkSize)
+	}
+
+	// undo several writes at once
+	assert.NoError(compressor.RevertTo(tokens[6]))
+	writeChunks(reference, 0, 6*chunkSize)
+	assert.Equal(reference.Bytes(), compressor.Bytes())
+	assert.Equal(reference.Stats(), compressor.Stats())
+	assert.Error(compressor.Revert())
+
+	// later checkpoints are gone, earlier ones remain
+	assert.Error(compressor.RevertTo(tokens[7]))
+	assert.NoError(compressor.RevertTo(tokens[3]))
+	reference.Reset()
+	writeChunks(reference, 0, 3*chunkSize)
+	assert.Equal(reference.Bytes(), compressor.Bytes())
+
+	// revert across a bypass
+	_, err = compressor.Write(craftExpandingInput(dict, 5000))
+	assert.NoError(err)
+	assert.True(compressor.ConsiderBypassing())
+	bypassed := compressor.Checkpoint()
+	bypassedBytes := bytes.Clone(compressor.Bytes())
+	_, err = compressor.Write(data[:chunkSize])
+	assert.NoError(err)
+	assert.NoError(compressor.RevertTo(bypassed))
+	assert.Equal(bypassedBytes, compressor.Bytes())
+
+	assert.NoError(compressor.RevertTo(tokens[2]))
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(data[:2*chunkSize], dBack)
+
+	// a bypassed checkpoint taken before a recompression is bypassed again
+	_, err = compressor.Write(craftExpandingInput(dict, 5000))
+	assert.NoError(err)
+	assert.True(compressor.ConsiderBypassing())
+	bypassed = compressor.Checkpoint()
+	bypassedBytes = bytes.Clone(compressor.Bytes())
+	_, err = compressor.Write(data[:chunkSize])
+	assert.NoError(err)
+	assert.NoError(compressor.Revert()) // recompresses
+	assert.NoError(compressor.RevertTo(bypassed))
+	assert.Equal(bypassedBytes, compressor.Bytes())
+	assert.NoError(compressor.RevertTo(tokens[1]))
+	assert.Error(compressor.RevertTo(bypassed))
+
+	// Revert drops the checkpoints taken after the reverted write
+	_, err = compressor.Write(data[chunkSize : 2*chunkSize])
+	assert.NoError(err)
+	token := compressor.Checkpoint()
+	assert.NoError(compressor.Revert())
+	assert.Error(compressor.RevertTo(token))
+
+	compressor.Reset()
+	assert.Error(compressor.RevertTo(0))
+}
+
+func TestConsiderBypassingWithThreshold(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/1-1865800")
+	assert.NoError(err)
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	// compressible data is kept compressed by default, but can be bypassed with a strict enough threshold
+	c, err := compressor.Compress(d[:10000])
+	assert.NoError(err)
+	ratio := float64(len(c)) / float64(10000+HeaderSize)
+	assert.False(compressor.ConsiderBypassing())
+	assert.False(compressor.ConsiderBypassingWithThreshold(ratio))
+	assert.True(compressor.ConsiderBypassingWithThreshold(ratio * 0.99))
+	assert.False(compressor.ConsiderBypassingWithThreshold(0), "already bypassed")
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(d[:10000], dBack)
+
+	// expanding data can be kept compressed with a lenient threshold
+	_, err = compressor.Compress(craftExpandingInput(dict, 1000))
+	assert.NoError(err)
+	assert.False(compressor.ConsiderBypassingWithThreshold(100))
+	assert.True(compressor.ConsiderBypassing())
+}
+
+func TestCompressStateless(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict, WithMicroBackrefs())
+	assert.NoError(err)
+	_, err = compressor.Write(d[:1000])
+	assert.NoError(err)
+	before := bytes.Clone(compressor.Bytes())
+
+	sizes := []int{0, 1, 2, 100, 10000, len(d)}
+	results := make([][]byte, len(sizes))
+	errs := make([]error, len(sizes))
+	var wg sync.WaitGroup
+	for i := range sizes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = compressor.CompressStateless(d[:sizes[i]])
+		}(i)
+	}
+	wg.Wait()
+
+	// the compressor is untouched
+	assert.Equal(before, compressor.Bytes())
+
+	for i, size := range sizes {
+		assert.NoError(errs[i])
+		c, err := compressor.Compress(d[:size])
+		assert.NoError(err)
+		assert.Equal(c, results[i], "size %d", size)
+	}
+
+	_, err = compressor.CompressStateless(make([]byte, MaxInputSize+1))
+	assert.Error(err)
+}
+
+func TestChecksum(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+
+	h := sha256.New()
+	sum := compressor.Checksum(h)
+	expected := sha256.Sum256(c)
+	assert.Equal(expected[:], sum)
+	assert.Equal(sum, compressor.Checksum(h), "the hash must be reset")
+
+	dBack, err := DecompressVerify(c, dict, sum, h)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	crc := compressor.Checksum(crc32.NewIEEE())
+	_, err = DecompressVerify(c, dict, crc, crc32.NewIEEE())
+	assert.NoError(err)
+
+	c[len(c)/2] ^= 1
+	_, err = DecompressVerify(c, dict, sum, h)
+	assert.ErrorIs(err, ErrChecksumMismatch)
+}
+
+func TestDictFingerprint(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict, WithDictFingerprint())
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+
+	var header Header
+	n, err := header.ReadFrom(bytes.NewReader(c))
+	assert.NoError(err)
+	assert.Equal(int64(HeaderSize+dictFingerprintSize), n)
+	assert.True(header.HasDictFingerprint)
+	size, err := compressor.CompressedSize(d)
+	assert.NoError(err)
+	assert.Equal(len(c), size)
+
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+	r, err := NewReader(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	dBack, err = io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// the fingerprint covers the augmented dictionary
+	_, err = Decompress(c, AugmentDict(dict))
+	assert.NoError(err)
+
+	for _, wrong := range [][]byte{nil, dict[1:], append(bytes.Clone(dict[:len(dict)-1]), dict[len(dict)-1]^1)} {
+		_, err = Decompress(c, wrong)
+		assert.ErrorIs(err, ErrDictMismatch)
+		_, err = NewReader(bytes.NewReader(c), wrong)
+		assert.ErrorIs(err, ErrDictMismatch)
+		_, err = CompressedStreamInfo(c, wrong)
+		assert.ErrorIs(err, ErrDictMismatch)
+	}
+
+	// bypassed compression does not depend on the dictionary
+	_, err = compressor.Compress([]byte{1, 2, 3})
+	assert.NoError(err)
+	assert.True(compressor.ConsiderBypassing())
+	dBack, err = Decompress(compressor.Bytes(), nil)
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 3}, dBack)
+}
+
+func TestResetKeepHeader(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:10000]
+	dict := getDictionary()
+
+	for _, opts := range [][]Option{nil, {WithDictFingerprint()}} {
+		compressor, err := NewCompressor(dict, opts...)
+		assert.NoError(err)
+		expected, err := compressor.Compress(d)
+		assert.NoError(err)
+		expected = bytes.Clone(expected)
+
+		_, err = compressor.Write(d[:5000])
+		assert.NoError(err)
+		compressor.ResetKeepHeader()
+		_, err = compressor.Write(d)
+		assert.NoError(err)
+		assert.Equal(expected, compressor.Bytes())
+
+		// after bypassing, the header must be rewritten
+		assert.True(compressor.ConsiderBypassingWithThreshold(0))
+		compressor.ResetKeepHeader()
+		_, err = compressor.Write(d)
+		assert.NoError(err)
+		assert.Equal(expected, compressor.Bytes())
+
+		assert.Zero(testing.AllocsPerRun(10, compressor.ResetKeepHeader))
+	}
+}
+
+func TestEstimateCompressedBits(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	for _, opts := range [][]Option{nil, {WithLongBackrefs(), WithDictFingerprint()}} {
+		compressor, err := NewCompressor(dict, opts...)
+		assert.NoError(err)
+		for _, in := range [][]byte{nil, d[:1000], d} {
+			c, err := compressor.Compress(in)
+			assert.NoError(err)
+			nbBits, err := EstimateCompressedBits(dict, in, opts...)
+			assert.NoError(err)
+			assert.Equal(len(c), (nbBits+7)/8)
+			assert.Greater(nbBits, 8*len(c)-8)
+		}
+	}
+
+	_, err = EstimateCompressedBits(dict, make([]byte, MaxInputSize+1))
+	assert.Error(err)
+}
+
+func TestValidateDictionary(t *testing.T) {
+	assert := require.New(t)
+
+	// the reach of a symbol shrinks by the distance from its last occurrence to the end of the dictionary
+	maxAddress := NewDynamicBackrefType(0, 0).maxAddress
+
+	_, err := ValidateDictionary(nil)
+	assert.NoError(err)
+	_, err = ValidateDictionary(getDictionary(), WithMicroBackrefs(), WithRawSpans())
+	assert.NoError(err)
+	symbols, err := ValidateDictionary([]byte{SymbolDynamic, 1, 2, SymbolShort})
+	assert.NoError(err)
+	assert.Equal([]ReservedSymbol{{SymbolShort, []int{3}, maxAddress - 1}, {SymbolDynamic, []int{0}, maxAddress - 4}}, symbols)
+	symbols, err = ValidateDictionary([]byte{SymbolDynamic, 1, 2, SymbolShort}, WithAdaptiveAddresses())
+	assert.NoError(err)
+	assert.Equal(maxAddress-4, symbols[1].Reach)
+
+	// the symbols reserved by the options are appended, all of them if any is missing
+	symbols, err = ValidateDictionary([]byte{SymbolDynamic, SymbolRaw, SymbolShort}, WithMicroBackrefs(), WithRawSpans())
+	assert.NoError(err)
+	assert.Equal([]ReservedSymbol{
+		{SymbolShort, []int{2, 3}, maxAddress - 4},
+		{SymbolDynamic, []int{0, 4}, maxAddress - 3},
+		{SymbolMicro, []int{5}, maxAddress - 2},
+		{SymbolRaw, []int{1, 6}, maxAddress - 1},
+	}, symbols)
+	symbols, err = ValidateDictionary([]byte{1, SymbolShort}, WithDelimiters(0xFA, 0xFB))
+	assert.NoError(err)
+	assert.Equal([]ReservedSymbol{{0xFA, []int{2}, maxAddress - 2}, {0xFB, []int{3}, maxAddress - 1}}, symbols)
+
+	// the reserved symbols are present, so they are not appended, but they are out of reach
+	dict := append([]byte{SymbolShort, SymbolDynamic}, make([]byte, maxAddress)...)
+	symbols, err = ValidateDictionary(dict)
+	assert.ErrorContains(err, "reserved symbol 0xfe last appears at offset 0")
+	assert.ErrorContains(err, "reserved symbol 0xff last appears at offset 1")
+	assert.Equal([]ReservedSymbol{{SymbolShort, []int{0}, -1}, {SymbolDynamic, []int{1}, -1}}, symbols)
+
+	// just within reach
+	_, err = ValidateDictionary(dict[:maxAddress])
+	assert.NoError(err)
+
+	// the symbols reserved by the options are checked too
+	dict = append([]byte{SymbolMicro}, dict[:maxAddress]...)
+	_, err = ValidateDictionary(dict)
+	assert.NoError(err)
+	_, err = ValidateDictionary(dict, WithMicroBackrefs())
+	assert.ErrorContains(err, "reserved symbol 0xfd last appears at offset 0")
+
+	_, err = ValidateDictionary(make([]byte, MaxDictSize))
+	assert.ErrorContains(err, "must be <= ")
+	assert.NotContains(err.Error(), "reserved symbol")
+	// the augmented length depends on the options
+	dict = append(make([]byte, MaxDictSize-3), SymbolShort, SymbolDynamic)
+	_, err = ValidateDictionary(dict)
+	assert.NoError(err)
+	_, err = ValidateDictionary(dict, WithMicroBackrefs())
+	assert.ErrorContains(err, "must be <= ")
+
+	_, err = ValidateDictionary(nil, WithDelimiters(0xFA, 0xFA))
+	assert.Error(err)
+
+	// the caller's dictionary is left untouched
+	dict = bytes.Repeat([]byte{1}, 10)
+	_, err = ValidateDictionary(dict[:5])
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{1}, 10), dict)
+}
+
+// TestValidateDictionaryReach checks that a reserved symbol is within reach of backrefs up to its Reach in the input, and no further
+func TestValidateDictionaryReach(t *testing.T) {
+	assert := require.New(t)
+
+	// the only SymbolDynamic is at the beginning of a 1MB dictionary
+	dict := make([]byte, 1<<20)
+	dict[0] = SymbolDynamic
+	dict[len(dict)-1] = SymbolShort
+	symbols, err := ValidateDictionary(dict)
+	assert.NoError(err)
+	reach := symbols[1].Reach
+	assert.Equal(1<<20, reach)
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	for _, i := range []int{reach, reach + 1} {
+		d := append(make([]byte, i), SymbolDynamic)
+		c, err := compressor.Compress(d)
+		assert.NoError(err)
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+		// past its reach, the symbol can only be stored with compression bypassed
+		assert.Equal(i > reach, len(c) == HeaderSize+len(d))
+	}
+}
+
+func TestWriteUpTo(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/average_block.hex")
+	assert.NoError(err)
+	data, err := hex.DecodeString(string(d))
+	assert.NoError(err)
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	other, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	for _, maxOutLen := range []int{0, HeaderSize, 100, 1000, 5000, len(data)} {
+		compressor.Reset()
+		_, err = compressor.Write(data[:200])
+		assert.NoError(err)
+		lenBefore := compressor.Len()
+
+		n, err := compressor.WriteUpTo(data[200:], maxOutLen)
+		assert.NoError(err)
+		if maxOutLen < lenBefore {
+			assert.Zero(n)
+		} else {
+			assert.LessOrEqual(compressor.Len(), maxOutLen)
+		}
+		dBack, err := Decompress(compressor.Bytes(), dict)
+		assert.NoError(err)
+		assert.Equal(data[:200+n], dBack)
+
+		// one more byte does not fit, compressed or not
+		if 200+n < len(data) {
+			other.Reset()
+			_, err = other.Write(data[:200])
+			assert.NoError(err)
+			_, err = other.Write(data[200 : 200+n+1])
+			assert.NoError(err)
+			assert.True(other.Len() > maxOutLen && 200+n+1+HeaderSize > maxOutLen)
+		}
+
+		// Revert undoes the whole call
+		assert.NoError(compressor.Revert())
+		assert.Equal(lenBefore, compressor.Len())
+	}
+
+	// data that only fits uncompressed
+	expanding := craftExpandingInput(dict, 1000)
+	compressor.Reset()
+	n, err := compressor.WriteUpTo(expanding, len(expanding)+HeaderSize)
+	assert.NoError(err)
+	assert.Equal(len(expanding), n)
+	assert.Equal(len(expanding)+HeaderSize, compressor.Len())
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(expanding, dBack)
+
+	// once bypassed, whatever fits is copied
+	n, err = compressor.WriteUpTo(data, compressor.Len()+10)
+	assert.NoError(err)
+	assert.Equal(10, n)
+	dBack, err = Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(append(bytes.Clone(expanding), data[:10]...), dBack)
+}
+
+func TestLookahead(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:100000]
+	dict := getDictionary()
+
+	sizes := make(map[int]int)
+	for _, depth := range []int{0, 1, 2, 3, maxLookahead} {
+		compressor, err := NewCompressor(dict, WithLookahead(depth))
+		assert.NoError(err)
+		c, err := compressor.Compress(d)
+		assert.NoError(err)
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+		sizes[depth] = len(c)
+
+		size, err := compressor.CompressedSize(d)
+		assert.NoError(err)
+		assert.Equal(len(c), size)
+	}
+	assert.Greater(sizes[0], sizes[2])
+
+	// the default is unchanged
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	assert.Equal(sizes[2], len(c))
+
+	for _, depth := range []int{-1, maxLookahead + 1} {
+		_, err = NewCompressor(dict, WithLookahead(depth))
+		assert.Error(err)
+		_, err = EstimateCompressedBits(dict, d, WithLookahead(depth))
+		assert.Error(err)
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:20000]
+	dict := getDictionary()
+
+	// random data is incompressible; part of it is longer than a single span
+	random := make([]byte, 1<<rawLenLog2+1000)
+	_, err = rand.Read(random)
+	assert.NoError(err)
+	random[10] = SymbolRaw
+
+	compressor, err := NewCompressor(dict, WithRawSpans())
+	assert.NoError(err)
+	_, err = compressor.Write(d[:10000])
+	assert.NoError(err)
+	assert.NoError(compressor.WriteRaw(random))
+	lenBefore := compressor.Len()
+	// reverting a raw span restores the previous state
+	assert.NoError(compressor.WriteRaw(d))
+	assert.NoError(compressor.Revert())
+	assert.Equal(lenBefore, compressor.Len())
+	// later input may refer back to the raw span, and SymbolRaw cannot be a literal
+	tail := append(bytes.Clone(random[:100]), d[10000:]...)
+	_, err = compressor.Write(tail)
+	assert.NoError(err)
+	assert.Equal(len(random), compressor.Stats().RawBytes)
+
+	expected := append(append(bytes.Clone(d[:10000]), random...), tail...)
+	c := compressor.Bytes()
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(expected, dBack)
+
+	decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	dBack, err = io.ReadAll(decompressor)
+	assert.NoError(err)
+	assert.Equal(expected, dBack)
+
+	phrases, err := CompressedStreamInfo(c, dict)
+	assert.NoError(err)
+	nbRaw := 0
+	var raw []byte
+	for _, phrase := range phrases {
+		if phrase.Type == SymbolRaw {
+			nbRaw++
+			raw = append(raw, phrase.Content...)
+		}
+	}
+	assert.Equal(2, nbRaw)
+	assert.Equal(random, raw)
+
+	// raw spans must be enabled
+	compressor, err = NewCompressor(dict)
+	assert.NoError(err)
+	assert.Error(compressor.WriteRaw(random))
+}
+
+func TestCompressCtx(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:50000]
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	expected, err := compressor.Compress(d)
+	assert.NoError(err)
+	expected = bytes.Clone(expected)
+	c, err := compressor.CompressCtx(context.Background(), d)
+	assert.NoError(err)
+	assert.Equal(expected, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err = compressor.CompressCtx(ctx, d)
+	assert.ErrorIs(err, context.Canceled)
+	assert.Nil(c)
+
+	// cancel midway
+	ctx, cancel = context.WithCancel(context.Background())
+	lastPos := 0
+	compressor.SetDecisionTrace(func(pos int, _ Decision) {
+		if pos >= 10000 {
+			cancel()
+		}
+		lastPos = pos
+	})
+	c, err = compressor.CompressCtx(ctx, d)
+	assert.ErrorIs(err, context.Canceled)
+	assert.Nil(c)
+	assert.Less(lastPos, 10000+ctxCheckInterval+1<<maxBackrefLenLog2)
+	compressor.SetDecisionTrace(nil)
+
+	// the compressor is usable again
+	c, err = compressor.Compress(d)
+	assert.NoError(err)
+	assert.Equal(expected, c)
+}
+
+func TestDictSavingsBits(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:50000]
+
+	compressor, err := NewCompressor(getDictionary())
+	assert.NoError(err)
+	_, err = compressor.Write(d[:100])
+	assert.NoError(err)
+	lenBefore := compressor.Len()
+
+	savings, err := compressor.DictSavingsBits(d)
+	assert.NoError(err)
+	assert.Positive(savings)
+	assert.Equal(lenBefore, compressor.Len())
+	assert.Equal(100, compressor.Written())
+
+	// it matches the decisions made by the compressor
+	expected := 0
+	compressor.SetDecisionTrace(func(_ int, decision Decision) {
+		if decision.FromDict {
+			expected += decision.DynamicSavings
+		}
+	})
+	_, err = compressor.Compress(d)
+	assert.NoError(err)
+	assert.Equal(expected, savings)
+
+	// without a dictionary, only the reserved symbols are taken from it
+	compressor, err = NewCompressor(nil)
+	assert.NoError(err)
+	savings, err = compressor.DictSavingsBits(d)
+	assert.NoError(err)
+	assert.LessOrEqual(savings, 0)
+}
+
+func TestRLEThreshold(t *testing.T) {
+	assert := require.New(t)
+
+	dict := getDictionary()
+	d := append([]byte{'h', 'i'}, make([]byte, 50)...)
+	d = append(d, bytes.Repeat([]byte{'a', 'b'}, 30)...)
+	d = append(d, bytes.Repeat([]byte{SymbolDynamic}, 100)...)
+
+	for _, threshold := range []int{2, 50, defaultRLEThreshold} {
+		compressor, err := NewCompressor(dict, WithRLEThreshold(threshold))
+		assert.NoError(err)
+		c, err := compressor.Compress(d)
+		assert.NoError(err)
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		invocations, _ := compressor.RLEStats()
+		if threshold == defaultRLEThreshold {
+			assert.Zero(invocations)
+		} else {
+			assert.Positive(invocations)
+		}
+	}
+
+	_, err := NewCompressor(dict, WithRLEThreshold(1))
+	assert.Error(err)
+}
+
+func TestWithDelimiters(t *testing.T) {
+	assert := require.New(t)
+
+	// isolated 0xFF bytes, which cannot be covered by backrefs to earlier runs
+	d := make([]byte, 30000)
+	rng := rand.New(rand.NewSource(0))
+	for i := range d {
+		if d[i] = byte(rng.Intn(0xF0)); rng.Intn(8) == 0 {
+			d[i] = 0xFF
+		}
+	}
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	sizeDefault := len(c)
+
+	for _, opts := range [][]Option{
+		{WithDelimiters(0xFA, 0xFB)},
+		{WithDelimiters(SymbolDynamic, SymbolShort)},
+		{WithDelimiters(0xFA, 0xFB), WithMicroBackrefs(), WithRawSpans(), WithDictFingerprint()},
+	} {
+		compressor, err = NewCompressor(dict, opts...)
+		assert.NoError(err)
+		c, err = compressor.Compress(d)
+		assert.NoError(err)
+
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+		assert.NoError(err)
+		dBack, err = io.ReadAll(decompressor)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		phrases, err := CompressedStreamInfo(c, dict)
+		assert.NoError(err)
+		var content []byte
+		for _, phrase := range phrases {
+			content = append(content, phrase.Content[:phrase.Length]...)
+		}
+		assert.Equal(d, content)
+	}
+
+	compressor, err = NewCompressor(dict, WithDelimiters(0xFA, 0xFB))
+	assert.NoError(err)
+	c, err = compressor.Compress(d)
+	assert.NoError(err)
+	assert.Less(len(c), sizeDefault*9/10)
+
+	for _, opts := range [][]Option{
+		{WithDelimiters(0xFA, 0xFA)},
+		{WithDelimiters(SymbolMicro, 0xFA), WithMicroBackrefs()},
+		{WithDelimiters(0xFA, SymbolRaw), WithRawSpans()},
+	} {
+		_, err = NewCompressor(dict, opts...)
+		assert.Error(err)
 	}
-	return b
 }
@@ -2,9 +2,14 @@ package lzss
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"sort"
 	"strconv"
 
 	"github.com/icza/bitio"
@@ -12,75 +17,279 @@ import (
 
 // Decompress decompresses the given data using the given dictionary
 // the dictionary must be the same as the one used to compress the data
-// Note that this is not a fail-safe decompressor, it will fail ungracefully if the data
-// has a different format than the one expected
+// Malformed data results in an error; every backref is validated before it is followed.
 func Decompress(data, dict []byte) (d []byte, err error) {
-	in := bitio.NewReader(bytes.NewReader(data))
+	return decompress(make([]byte, 0, len(data)*7), data, dict, decompressOptions{maxOut: -1})
+}
 
-	// parse header
+// progressInterval is the number of decompressed bytes between two calls to the progress callback
+const progressInterval = 1 << 16
+
+// DecompressWithProgress is the same as Decompress, but calls progress every 64KB of output
+// and once more when decompression is complete.
+func DecompressWithProgress(data, dict []byte, progress func(compressedBitsRead, decompressedBytes int)) ([]byte, error) {
+	return decompress(make([]byte, 0, len(data)*7), data, dict, decompressOptions{maxOut: -1, progress: progress})
+}
+
+// DecompressN is the same as Decompress, but allows data to continue past the end of the compressed stream,
+// and returns the number of bytes the stream spans.
+// Only block containers record where they end, so data must start with one, as produced by CompressParallel or
+// WindowedCompressor. Any other stream is rejected, since its trailing bytes would be indistinguishable from literals.
+func DecompressN(data, dict []byte) (out []byte, bytesConsumed int, err error) {
 	var header Header
-	sizeHeader, err := header.ReadFrom(in)
+	if _, err = header.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !header.Blocks {
+		return nil, 0, errors.New("only block containers record where they end")
+	}
+	if bytesConsumed, err = containerSize(data); err != nil {
+		return nil, 0, err
+	}
+	if out, err = Decompress(data[:bytesConsumed], dict); err != nil {
+		return nil, 0, err
+	}
+	return out, bytesConsumed, nil
+}
+
+// ErrOutputTooLarge is returned when the decompressed data does not fit in the space allowed for it
+var ErrOutputTooLarge = errors.New("decompressed data too large")
+
+// ErrTruncatedStream is returned when the compressed data ends in the middle of a phrase or of a block container.
+// It wraps io.ErrUnexpectedEOF. Since phrases are not byte-aligned and the last byte is padded, a stream cut right
+// after a phrase, or within the last byte of a literal, cannot be told apart from a complete one.
+var ErrTruncatedStream = fmt.Errorf("compressed data truncated: %w", io.ErrUnexpectedEOF)
+
+// DecompressTo decompresses the given data into dst, and returns the number of bytes written.
+// It returns ErrOutputTooLarge if dst is too small to hold the decompressed data.
+func DecompressTo(dst, data, dict []byte) (n int, err error) {
+	out, err := decompress(dst[:0], data, dict, decompressOptions{maxOut: len(dst)})
+	return len(out), err
+}
+
+// DecompressLimit is the same as Decompress, but returns ErrOutputTooLarge as soon as the decompressed data would exceed
+// maxOut bytes. Unlike DecompressTo, it only allocates as much memory as the output actually needs, so it is suited
+// to untrusted data, which may otherwise decompress to far more than any reasonable size.
+func DecompressLimit(data, dict []byte, maxOut int) ([]byte, error) {
+	if maxOut < 0 {
+		return nil, errors.New("max output size must be non-negative")
+	}
+	return decompress(make([]byte, 0, min(len(data)*7, maxOut)), data, dict, decompressOptions{maxOut: maxOut})
+}
+
+// DecompressWithDictCoverage is the same as Decompress, but also reports which bytes of the dictionary were referenced:
+// coverage[i] is true if dict[i] was copied by any backref into the dictionary.
+// The reserved symbols appended to the dictionary, if any, are not covered.
+func DecompressWithDictCoverage(data, dict []byte) (out []byte, coverage []bool, err error) {
+	coverage = make([]bool, len(dict))
+	out, err = decompress(make([]byte, 0, len(data)*7), data, dict, decompressOptions{maxOut: -1, dictCoverage: coverage})
 	if err != nil {
+		return nil, nil, err
+	}
+	return out, coverage, nil
+}
+
+// ErrChecksumMismatch is returned when the compressed data does not match the expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// DecompressVerify is the same as Decompress, but first checks that the checksum of data under h is expected,
+// as computed by Compressor.Checksum. h is reset before use.
+func DecompressVerify(data, dict, expected []byte, h hash.Hash) ([]byte, error) {
+	if !bytes.Equal(checksum(h, data), expected) {
+		return nil, ErrChecksumMismatch
+	}
+	return Decompress(data, dict)
+}
+
+// checksum returns the digest of data under h, after resetting h
+func checksum(h hash.Hash, data []byte) []byte {
+	h.Reset()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// DecompressAugmented is the same as Decompress, but expects a dictionary that already contains the reserved symbols,
+// e.g. as returned by AugmentDict, and fails rather than augmenting it.
+// Augmenting a dictionary twice is harmless, since AugmentDict leaves a dictionary with the reserved symbols unchanged;
+// what this guards against is a dictionary augmented for different settings than the data's. Data compressed
+// WithMicroBackrefs also reserves SymbolMicro, so with a dictionary lacking it, Decompress would append three symbols
+// rather than none, shifting every address into the dictionary.
+func DecompressAugmented(data, augmentedDict []byte) ([]byte, error) {
+	return decompress(make([]byte, 0, len(data)*7), data, augmentedDict, decompressOptions{maxOut: -1, dictAugmented: true})
+}
+
+// decompressOptions tunes the behavior of decompress
+type decompressOptions struct {
+	progress      func(compressedBitsRead, decompressedBytes int) // called periodically if not nil
+	maxOut        int                                             // max number of bytes to decompress; no limit if negative
+	dictCoverage  []bool                                          // if not nil, marks the bytes of the dictionary that are referenced
+	dictAugmented bool                                            // the dictionary must already contain the reserved symbols
+}
+
+// decoder appends to out the decompressed data of a stream whose header has already been parsed
+type decoder func(out, data, dict []byte, header *Header, opts decompressOptions) ([]byte, error)
+
+// decoders maps each format version Decompress can read to its decoder.
+// When the format evolves, the decoders of earlier versions are kept so that data compressed by earlier releases remains readable.
+var decoders = map[uint16]decoder{}
+
+func init() {
+	// registered here rather than in the declaration of decoders, which block containers would make an initialization cycle
+	decoders[1] = decompressV1
+}
+
+// SupportedVersions returns the format versions Decompress can read, in increasing order.
+// Compressors always produce the latest, Version.
+func SupportedVersions() []uint16 {
+	versions := make([]uint16, 0, len(decoders))
+	for v := range decoders {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// checkVersion returns an error if no decoder is registered for the given version
+func checkVersion(version uint16) error {
+	if _, ok := decoders[version]; !ok {
+		return fmt.Errorf("unsupported compressor version %d", version)
+	}
+	return nil
+}
+
+// decompress appends the decompressed data to out, dispatching on the version of the header
+func decompress(out, data, dict []byte, opts decompressOptions) ([]byte, error) {
+	var header Header
+	if _, err := header.ReadFrom(bytes.NewReader(data)); err != nil {
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
-	if header.Version != Version {
-		return nil, errors.New("unsupported compressor version")
+	if err := checkVersion(header.Version); err != nil {
+		return nil, err
+	}
+	return decoders[header.Version](out, data, dict, &header, opts)
+}
+
+// decompressV1 is the decoder of version 1 streams
+func decompressV1(out, data, dict []byte, header *Header, opts decompressOptions) ([]byte, error) {
+	sizeHeader := header.size()
+	in := bitio.NewReader(bytes.NewReader(data[sizeHeader:]))
+
+	if header.Blocks {
+		return decompressBlocks(out, data[sizeHeader:], dict, opts)
+	}
+
+	outStart := len(out)
+	fits := func(n int) bool {
+		return opts.maxOut < 0 || len(out)-outStart+n <= opts.maxOut
 	}
+
 	if header.NoCompression {
-		return data[sizeHeader:], nil
+		if !fits(len(data) - int(sizeHeader)) {
+			return nil, ErrOutputTooLarge
+		}
+		out = append(out, data[sizeHeader:]...)
+		if opts.progress != nil {
+			opts.progress(8*len(data), len(out)-outStart)
+		}
+		return out, nil
 	}
 
 	// init dict and backref types
-	dict = AugmentDict(dict)
+	augmented := augmentDict(dict, header.reservedSymbols()...)
+	if opts.dictAugmented && len(augmented) != len(dict) {
+		return nil, fmt.Errorf("the dictionary lacks some of the reserved symbols %x", header.reservedSymbols())
+	}
+	dict = augmented
+	if err := header.checkDict(dict); err != nil {
+		return nil, err
+	}
 
-	shortType := NewShortBackrefType()
-	bShort := backref{bType: shortType}
+	bShort := backref{bType: newShortBackrefType(header.backrefLenLog2())}
+	bMicro := backref{bType: newMicroBackrefType()}
 
-	var out bytes.Buffer
-	out.Grow(len(data) * 7)
+	bitsRead := 8 * int(sizeHeader)
+	nextProgress := progressInterval
 
 	// read byte per byte; if it's a backref, write the corresponding bytes
 	// otherwise, write the byte as is
 	s := in.TryReadByte()
 	for in.TryError == nil {
-		switch s {
-		case SymbolShort:
-			// short back ref
-			if err := bShort.readFrom(in); err != nil {
+		bitsRead += 8
+		switch t := header.phraseType(s); t {
+		case SymbolShort, SymbolMicro:
+			// short or micro back ref
+			b := &bShort
+			if t == SymbolMicro {
+				b = &bMicro
+			}
+			if err := b.readFrom(in); err != nil {
 				return nil, err
 			}
-			for i := 0; i < bShort.length; i++ {
-				if bShort.address > out.Len() {
-					return nil, fmt.Errorf("invalid short backref %+v - output buffer is only %d bytes long", bShort, out.Len())
-				}
-				out.WriteByte(out.Bytes()[out.Len()-bShort.address])
+			bitsRead += int(b.bType.NbBitsBackRef) - 8
+			if b.address > len(out)-outStart {
+				return nil, fmt.Errorf("invalid short backref %+v - output buffer is only %d bytes long", *b, len(out)-outStart)
+			}
+			if !fits(b.length) {
+				return nil, ErrOutputTooLarge
+			}
+			for i := 0; i < b.length; i++ {
+				out = append(out, out[len(out)-b.address])
 			}
 		case SymbolDynamic:
 			// long back ref
-			dynamicbr := NewDynamicBackrefType(len(dict), out.Len())
+			dynamicbr := header.dynamicBackrefType(len(dict), len(out)-outStart)
 			bDynamic := backref{bType: dynamicbr}
 			if err := bDynamic.readFrom(in); err != nil {
 				return nil, err
 			}
-			if bDynamic.address > out.Len() {
-				dictStart := len(dict) - (bDynamic.address - out.Len())
+			bitsRead += int(dynamicbr.NbBitsBackRef) - 8
+			if !fits(bDynamic.length) {
+				return nil, ErrOutputTooLarge
+			}
+			if bDynamic.address > len(out)-outStart {
+				dictStart := len(dict) - (bDynamic.address - (len(out) - outStart))
 				if dictStart < 0 || dictStart > len(dict) || dictStart+bDynamic.length > len(dict) {
 					return nil, fmt.Errorf("invalid dynamic backref %+v - dict is only %d bytes long; dictStart = %d", bDynamic, len(dict), dictStart)
 				}
-				out.Write(dict[dictStart : dictStart+bDynamic.length])
+				out = append(out, dict[dictStart:dictStart+bDynamic.length]...)
+				for i := dictStart; i < min(dictStart+bDynamic.length, len(opts.dictCoverage)); i++ {
+					opts.dictCoverage[i] = true
+				}
 			} else {
 				for i := 0; i < bDynamic.length; i++ {
-					out.WriteByte(out.Bytes()[out.Len()-bDynamic.address])
+					out = append(out, out[len(out)-bDynamic.address])
 				}
 			}
+		case SymbolRaw:
+			n, err := readRawSpanLen(in)
+			if err != nil {
+				return nil, err
+			}
+			if !fits(n) {
+				return nil, ErrOutputTooLarge
+			}
+			if out, err = readRawSpan(in, out, n); err != nil {
+				return nil, err
+			}
+			bitsRead += rawLenLog2 + 8*n
 
 		default:
-			out.WriteByte(s)
+			if !fits(1) {
+				return nil, ErrOutputTooLarge
+			}
+			out = append(out, s)
+		}
+		if opts.progress != nil && len(out)-outStart >= nextProgress {
+			opts.progress(bitsRead, len(out)-outStart)
+			nextProgress = len(out) - outStart + progressInterval
 		}
 		s = in.TryReadByte()
 	}
 
-	return out.Bytes(), nil
+	if opts.progress != nil {
+		opts.progress(bitsRead, len(out)-outStart)
+	}
+	return out, nil
 }
 
 type CompressionPhrase struct {
@@ -90,45 +299,79 @@ type CompressionPhrase struct {
 	StartDecompressed int
 	StartCompressed   int
 	Content           []byte
+	FromDict          bool // the phrase is a dynamic backref into the dictionary
+	DictOffset        int  // offset in the augmented dictionary of the bytes referenced, if FromDict
 }
 
 type CompressionPhrases []CompressionPhrase
 
 func CompressedStreamInfo(c, dict []byte) (CompressionPhrases, error) {
+	var res CompressionPhrases
+	err := WalkCompressedStream(c, dict, func(phrase CompressionPhrase) error {
+		phrase.Content = bytes.Clone(phrase.Content)
+		res = append(res, phrase)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// WalkCompressedStream calls fn on each phrase of the compressed data, in order, as CompressedStreamInfo would return them.
+// It stops at the first error returned by fn, and returns it.
+// Only the part of the output that backrefs can reach is retained, so that memory use remains bounded
+// (save for long runs of literals, which are reported as a single phrase).
+// The Content of a phrase is only valid until fn returns.
+func WalkCompressedStream(c, dict []byte, fn func(CompressionPhrase) error) error {
 	in := bitio.NewReader(bytes.NewReader(c))
 
 	// parse header
 	var header Header
 	sizeHeader, err := header.ReadFrom(in)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if header.Version != Version {
-		panic("unsupported compressor version")
+	if err = checkVersion(header.Version); err != nil {
+		return err
+	}
+	if header.Blocks {
+		return errors.New("block containers are not supported; analyze each block separately")
 	}
 	if header.NoCompression {
-		return CompressionPhrases{{
+		return fn(CompressionPhrase{
 			Type:              0,
 			Length:            len(c) - int(sizeHeader),
 			ReferenceAddress:  0,
 			StartDecompressed: 0,
 			StartCompressed:   0,
 			Content:           c[sizeHeader:],
-		}}, nil
+		})
 	}
 
-	var res CompressionPhrases
-
 	// init dict and backref types
-	dict = AugmentDict(dict)
-	shortBackRefType := NewShortBackrefType()
+	dict = augmentDict(dict, header.reservedSymbols()...)
+	if err := header.checkDict(dict); err != nil {
+		return err
+	}
 
-	bShort := backref{bType: shortBackRefType}
+	bShort := backref{bType: newShortBackrefType(header.backrefLenLog2())}
+	bMicro := backref{bType: newMicroBackrefType()}
 
-	var out bytes.Buffer
-	out.Grow(len(c) * 7)
-	if _, err = out.Write(dict); err != nil {
-		return nil, err
+	// positions are counted from the beginning of the dictionary, which precedes the output.
+	// window holds the output from position windowStart on.
+	outLen := len(dict)
+	windowStart := len(dict)
+	window := make([]byte, 0, min(len(c)*7, 2*maxWindowSize))
+	at := func(i int) byte {
+		if i < len(dict) {
+			return dict[i]
+		}
+		return window[i-windowStart]
+	}
+	write := func(b byte) {
+		window = append(window, b)
+		outLen++
 	}
 
 	// the decompressor considers the direct copying of each byte of the input its own event.
@@ -138,87 +381,139 @@ func CompressedStreamInfo(c, dict []byte) (CompressionPhrases, error) {
 	literalCopyStart := -1
 	inI := 0
 
-	emitLiteralIfNecessary := func() {
+	emitLiteralIfNecessary := func() error {
 		if literalCopyStart == -1 {
-			return
+			return nil
 		}
-		res = append(res, CompressionPhrase{
+		err := fn(CompressionPhrase{
 			Type:              0,
-			Length:            out.Len() - literalCopyStart,
+			Length:            outLen - literalCopyStart,
 			ReferenceAddress:  literalCopyStart,
 			StartDecompressed: literalCopyStart,
 			StartCompressed:   inI,
-			Content:           out.Bytes()[literalCopyStart:],
+			Content:           window[literalCopyStart-windowStart:],
 		})
-		inI += (out.Len() - literalCopyStart) * 8
+		inI += (outLen - literalCopyStart) * 8
 		literalCopyStart = -1
+		return err
 	}
 
-	emitRef := func(b *backref) {
-		addr := out.Len() - b.length - b.address // this happens post writing out the backref
-		res = append(res, CompressionPhrase{
+	emitRef := func(b *backref) error {
+		addr := outLen - b.length - b.address // this happens post writing out the backref
+		phrase := CompressionPhrase{
 			Type:              b.bType.Delimiter,
 			Length:            b.length,
 			ReferenceAddress:  addr,
-			StartDecompressed: out.Len() - b.length,
+			StartDecompressed: outLen - b.length,
 			StartCompressed:   inI,
-			Content:           out.Bytes()[out.Len()-b.length:],
-		})
+			Content:           window[outLen-b.length-windowStart:],
+		}
+		// the dictionary precedes the output, so this mirrors the dict-vs-output branch in decompress
+		if addr < len(dict) {
+			phrase.FromDict = true
+			phrase.DictOffset = addr
+		}
 		inI += int(b.bType.NbBitsBackRef)
+		return fn(phrase)
 	}
 
 	// read byte per byte; if it's a backref, write the corresponding bytes
 	// otherwise, write the byte as is
 	s := in.TryReadByte()
 	for in.TryError == nil {
-		switch s {
-		case SymbolShort:
-			emitLiteralIfNecessary()
-			// short back ref
-			if err := bShort.readFrom(in); err != nil {
-				return nil, err
+		// discard the output out of reach of backrefs, unless it is part of the current literal phrase
+		if literalCopyStart == -1 && len(window) >= 2*maxWindowSize {
+			n := copy(window, window[len(window)-maxWindowSize:])
+			windowStart += len(window) - n
+			window = window[:n]
+		}
+
+		switch t := header.phraseType(s); t {
+		case SymbolShort, SymbolMicro:
+			if err := emitLiteralIfNecessary(); err != nil {
+				return err
 			}
-			for i := 0; i < bShort.length; i++ {
-				out.WriteByte(out.Bytes()[out.Len()-bShort.address])
+			// short or micro back ref
+			b := &bShort
+			if t == SymbolMicro {
+				b = &bMicro
+			}
+			if err := b.readFrom(in); err != nil {
+				return err
+			}
+			if b.address > outLen-len(dict) {
+				return fmt.Errorf("invalid short backref %+v - output buffer is only %d bytes long", *b, outLen-len(dict))
+			}
+			for i := 0; i < b.length; i++ {
+				write(at(outLen - b.address))
+			}
+			if err := emitRef(b); err != nil {
+				return err
 			}
-			emitRef(&bShort)
 		case SymbolDynamic:
-			emitLiteralIfNecessary()
+			if err := emitLiteralIfNecessary(); err != nil {
+				return err
+			}
 			// long back ref
-			bDynamic := backref{bType: NewDynamicBackrefType(0, out.Len())}
+			bDynamic := backref{bType: header.dynamicBackrefType(0, outLen)}
 			if err := bDynamic.readFrom(in); err != nil {
-				return nil, err
+				return err
+			}
+			// the dictionary precedes the output; a backref into it must not cross over into the output
+			if dictStart := outLen - bDynamic.address; dictStart < 0 || (dictStart < len(dict) && dictStart+bDynamic.length > len(dict)) {
+				return fmt.Errorf("invalid dynamic backref %+v - dict is only %d bytes long; dictStart = %d", bDynamic, len(dict), dictStart)
 			}
 			for i := 0; i < bDynamic.length; i++ {
-				out.WriteByte(out.Bytes()[out.Len()-bDynamic.address])
+				write(at(outLen - bDynamic.address))
+			}
+			if err := emitRef(&bDynamic); err != nil {
+				return err
 			}
-			emitRef(&bDynamic)
+		case SymbolRaw:
+			if err := emitLiteralIfNecessary(); err != nil {
+				return err
+			}
+			start := outLen
+			n, err := readRawSpanLen(in)
+			if err != nil {
+				return err
+			}
+			if window, err = readRawSpan(in, window, n); err != nil {
+				return err
+			}
+			outLen += n
+			if err = fn(CompressionPhrase{
+				Type:              SymbolRaw,
+				Length:            outLen - start,
+				ReferenceAddress:  start,
+				StartDecompressed: start,
+				StartCompressed:   inI,
+				Content:           window[len(window)-n:],
+			}); err != nil {
+				return err
+			}
+			inI += 8 + rawLenLog2 + 8*(outLen-start)
 		default:
 			if literalCopyStart == -1 {
-				literalCopyStart = out.Len()
+				literalCopyStart = outLen
 			}
-			out.WriteByte(s)
+			write(s)
 		}
 		s = in.TryReadByte()
 	}
-	emitLiteralIfNecessary()
-	return res, nil
+	return emitLiteralIfNecessary()
 }
 
 func (c CompressionPhrases) ToCSV() []byte {
 	var b bytes.Buffer
-	b.WriteString("type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex)\n")
+	b.WriteString("type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\n")
 	for _, phrase := range c {
-		switch phrase.Type {
-		case SymbolShort:
-			b.WriteString("short,")
-		case SymbolDynamic:
-			b.WriteString("long,")
-		case 0:
-			b.WriteString("literal,")
-		default:
+		name, ok := phraseTypeNames[phrase.Type]
+		if !ok {
 			panic("unknown phrase type")
 		}
+		b.WriteString(name)
+		b.WriteString(",")
 
 		b.WriteString(strconv.Itoa(phrase.Length))
 		b.WriteString(",")
@@ -230,7 +525,84 @@ func (c CompressionPhrases) ToCSV() []byte {
 		b.WriteString(strconv.Itoa(phrase.ReferenceAddress))
 		b.WriteString(",")
 		b.WriteString(hex.EncodeToString(phrase.Content))
+		b.WriteString(",")
+		b.WriteString(strconv.FormatBool(phrase.FromDict))
+		b.WriteString(",")
+		b.WriteString(strconv.Itoa(phrase.DictOffset))
 		b.WriteString("\n")
 	}
 	return b.Bytes()
 }
+
+// phraseTypeNames are the names of the phrase types in CSV and JSON
+var phraseTypeNames = map[byte]string{
+	0:             "literal",
+	SymbolShort:   "short",
+	SymbolDynamic: "long",
+	SymbolMicro:   "micro",
+	SymbolRaw:     "raw",
+}
+
+// phraseType returns the type of phrase with the given name
+func phraseType(name string) (byte, error) {
+	for t, n := range phraseTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown phrase type %q", name)
+}
+
+// MarshalJSON encodes the phrase as a JSON object, with the same fields as its CSV representation.
+func (p CompressionPhrase) MarshalJSON() ([]byte, error) {
+	name, ok := phraseTypeNames[p.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown phrase type 0x%x", p.Type)
+	}
+	return json.Marshal(struct {
+		Type              string `json:"type"`
+		Length            int    `json:"length"`
+		StartDecompressed int    `json:"start_decompressed"`
+		StartCompressed   int    `json:"start_compressed"`
+		ReferenceAddress  int    `json:"reference_address"`
+		Content           string `json:"content"`
+		FromDict          bool   `json:"from_dict"`
+		DictOffset        int    `json:"dict_offset"`
+	}{name, p.Length, p.StartDecompressed, p.StartCompressed, p.ReferenceAddress, hex.EncodeToString(p.Content), p.FromDict, p.DictOffset})
+}
+
+// ParsePhrasesCSV parses phrases in the format produced by ToCSV.
+func ParsePhrasesCSV(data []byte) (CompressionPhrases, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = 8
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[0][0] != "type" {
+		return nil, errors.New("missing CSV header")
+	}
+
+	phrases := make(CompressionPhrases, len(records)-1)
+	for i, record := range records[1:] {
+		p := &phrases[i]
+		if p.Type, err = phraseType(record[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		for j, field := range []*int{&p.Length, &p.StartDecompressed, &p.StartCompressed, &p.ReferenceAddress} {
+			if *field, err = strconv.Atoi(record[j+1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+2, err)
+			}
+		}
+		if p.Content, err = hex.DecodeString(record[5]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if p.FromDict, err = strconv.ParseBool(record[6]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if p.DictOffset, err = strconv.Atoi(record[7]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+	}
+	return phrases, nil
+}
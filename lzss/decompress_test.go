@@ -0,0 +1,447 @@
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/icza/bitio"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDecompressReference decompresses a stream produced by the compressor and committed to testdata.
+// It does not depend on the compressor, so that it also runs in decompressonly builds.
+func TestDecompressReference(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+
+	dBack, err := Decompress(c, getDictionary())
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+func getDictionary() []byte {
+	d, err := os.ReadFile("./testdata/dict_naive")
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDecompressWithProgress(t *testing.T) {
+	assert := require.New(t)
+
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+
+	nbCalls, lastBitsRead, lastDecompressed := 0, 0, 0
+	d, err := DecompressWithProgress(c, getDictionary(), func(compressedBitsRead, decompressedBytes int) {
+		assert.GreaterOrEqual(compressedBitsRead, lastBitsRead)
+		assert.GreaterOrEqual(decompressedBytes, lastDecompressed)
+		nbCalls++
+		lastBitsRead, lastDecompressed = compressedBitsRead, decompressedBytes
+	})
+	assert.NoError(err)
+
+	assert.Equal(len(d), lastDecompressed)
+	assert.LessOrEqual(lastBitsRead, 8*len(c))
+	assert.Greater(lastBitsRead, 8*(len(c)-1))
+	assert.LessOrEqual(nbCalls, len(d)/progressInterval+1)
+	assert.Greater(nbCalls, 1)
+}
+
+func TestDecompressWithDictCoverage(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	dBack, coverage, err := DecompressWithDictCoverage(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+	assert.Len(coverage, len(dict))
+
+	// cross-check against the phrases; the dictionary sits at the beginning of their address space
+	expected := make([]bool, len(dict))
+	phrases, err := CompressedStreamInfo(c, dict)
+	assert.NoError(err)
+	for _, p := range phrases {
+		assert.Equal(p.Type == SymbolDynamic && p.ReferenceAddress < len(dict), p.FromDict)
+		if p.FromDict {
+			assert.Equal(p.ReferenceAddress, p.DictOffset)
+			assert.Equal(AugmentDict(dict)[p.DictOffset:p.DictOffset+p.Length], p.Content)
+			for i := p.DictOffset; i < min(p.DictOffset+p.Length, len(dict)); i++ {
+				expected[i] = true
+			}
+		}
+	}
+	assert.Equal(expected, coverage)
+	assert.Contains(coverage, true)
+	assert.Contains(coverage, false)
+
+	_, _, err = DecompressWithDictCoverage(c[:len(c)-1], dict)
+	assert.Error(err)
+}
+
+func TestDecompressN(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	// a plain stream does not record where it ends, so trailing data would be decoded as literals
+	_, _, err = DecompressN(c, dict)
+	assert.Error(err)
+	_, _, err = DecompressN(append(bytes.Clone(c), "trailing"...), dict)
+	assert.Error(err)
+
+	// a container holding the stream twice, followed by unrelated data
+	container := []byte{0, Version, flagBlocks, 0, 0, 0, 2}
+	for i := 0; i < 2; i++ {
+		container = binary.BigEndian.AppendUint32(container, uint32(len(c)))
+		container = append(container, c...)
+	}
+	dBack, n, err := DecompressN(append(container, "trailing"...), dict)
+	assert.NoError(err)
+	assert.Equal(append(d, d...), dBack)
+	assert.Equal(len(container), n)
+
+	_, _, err = DecompressN(container[:len(container)-1], dict)
+	assert.Error(err)
+	_, _, err = DecompressN(container[:HeaderSize+1], dict)
+	assert.Error(err)
+}
+
+func TestDecompressTo(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	dst := make([]byte, len(d)+10)
+	n, err := DecompressTo(dst, c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dst[:n])
+
+	// reuse the buffer
+	n, err = DecompressTo(dst[:len(d)], c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dst[:n])
+
+	_, err = DecompressTo(dst[:len(d)-1], c, dict)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+
+	// bypassed compression
+	c = append([]byte{0, Version, 1}, d[:100]...)
+	n, err = DecompressTo(dst, c, dict)
+	assert.NoError(err)
+	assert.Equal(d[:100], dst[:n])
+	_, err = DecompressTo(dst[:99], c, dict)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+}
+
+// FuzzDecompress checks that malformed inputs result in errors rather than panics
+func FuzzDecompress(f *testing.F) {
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(c[:1000], []byte{})
+	f.Add(c[:1000], getDictionary()[:1000])
+	f.Add([]byte{0, Version, 0, 'a', SymbolShort, 0, 0, 0}, []byte{})
+	f.Add([]byte{0, Version, 0, SymbolDynamic, 0xFF, 0xFF, 0xFF, 0xFF}, []byte{1, 2, 3})
+	f.Add([]byte{0, Version, 1, 1, 2, 3}, []byte{})
+
+	f.Fuzz(func(t *testing.T, data, dict []byte) {
+		d, err := Decompress(data, dict)
+
+		// the streaming decompressor must agree
+		r, errReader := NewReader(bytes.NewReader(data), dict)
+		if errReader == nil {
+			var dReader []byte
+			dReader, errReader = io.ReadAll(r)
+			if errReader == nil && err == nil && !bytes.Equal(d, dReader) {
+				t.Fatal("streaming decompressor output differs")
+			}
+		}
+		if (err == nil) != (errReader == nil) {
+			t.Fatalf("Decompress error %v but streaming decompressor error %v", err, errReader)
+		}
+
+		if err == nil {
+			if _, err = DecompressTo(make([]byte, len(d)/2), data, dict); len(d) > 1 && err == nil {
+				t.Fatal("expected an error decompressing into a small buffer")
+			}
+		}
+
+		_, _ = CompressedStreamInfo(data, dict)
+	})
+}
+
+func TestSupportedVersions(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal([]uint16{Version}, SupportedVersions())
+
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	c = bytes.Clone(c)
+	c[0], c[1] = 0xAB, 0xCD
+	_, err = Decompress(c, getDictionary())
+	assert.ErrorContains(err, "unsupported compressor version")
+	_, err = NewDecompressor(bytes.NewReader(c), getDictionary())
+	assert.ErrorContains(err, "unsupported compressor version")
+	err = WalkCompressedStream(c, getDictionary(), func(CompressionPhrase) error { return nil })
+	assert.ErrorContains(err, "unsupported compressor version")
+
+	// a registered decoder is dispatched to according to the header
+	decoders[0xABCD] = func(out, data, dict []byte, header *Header, opts decompressOptions) ([]byte, error) {
+		return append(out, data[header.size():header.size()+4]...), nil
+	}
+	defer delete(decoders, 0xABCD)
+	assert.Equal([]uint16{Version, 0xABCD}, SupportedVersions())
+	d, err := Decompress(c, getDictionary())
+	assert.NoError(err)
+	assert.Equal(c[HeaderSize:HeaderSize+4], d)
+}
+
+func TestPhrasesCSVAndJSON(t *testing.T) {
+	assert := require.New(t)
+
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	phrases, err := CompressedStreamInfo(c, getDictionary())
+	assert.NoError(err)
+
+	parsed, err := ParsePhrasesCSV(phrases.ToCSV())
+	assert.NoError(err)
+	assert.Equal(phrases, parsed)
+
+	phrases = phrases[:3]
+	phrases[0] = CompressionPhrase{Type: SymbolMicro, Length: 2, ReferenceAddress: 5, StartDecompressed: 7, StartCompressed: 64, Content: []byte{0xAB, 0xCD}}
+	j, err := json.Marshal(phrases[:1])
+	assert.NoError(err)
+	assert.JSONEq(`[{"type":"micro","length":2,"start_decompressed":7,"start_compressed":64,"reference_address":5,"content":"abcd","from_dict":false,"dict_offset":0}]`, string(j))
+
+	var decoded []struct {
+		Type string `json:"type"`
+	}
+	j, err = json.Marshal(phrases)
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal(j, &decoded))
+	assert.Len(decoded, len(phrases))
+
+	for _, bad := range []string{
+		"",
+		"literal,1,0,0,0,00,false,0\n",
+		"type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\nhuge,1,0,0,0,00,false,0\n",
+		"type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\nliteral,x,0,0,0,00,false,0\n",
+		"type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\nliteral,1,0,0,0,0,false,0\n",
+		"type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\nliteral,1,0,0,0,00,false\n",
+		"type,length,start_decompressed (bytes),start_compressed (bits),reference_address,content (hex),from_dict,dict_offset\nliteral,1,0,0,0,00,maybe,0\n",
+	} {
+		_, err = ParsePhrasesCSV([]byte(bad))
+		assert.Error(err, bad)
+	}
+}
+
+func TestWalkCompressedStream(t *testing.T) {
+	assert := require.New(t)
+
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+	phrases, err := CompressedStreamInfo(c, dict)
+	assert.NoError(err)
+
+	i := 0
+	assert.NoError(WalkCompressedStream(c, dict, func(p CompressionPhrase) error {
+		assert.Equal(phrases[i], p)
+		i++
+		return nil
+	}))
+	assert.Equal(len(phrases), i)
+
+	errStop := errors.New("stop")
+	i = 0
+	err = WalkCompressedStream(c, dict, func(p CompressionPhrase) error {
+		if i++; i == 10 {
+			return errStop
+		}
+		return nil
+	})
+	assert.ErrorIs(err, errStop)
+	assert.Equal(10, i)
+
+	// an output much larger than the window: short backrefs repeating a pattern, then a dynamic backref as far back as possible
+	var bb bytes.Buffer
+	bb.Write([]byte{0, Version, 0})
+	w := bitio.NewWriter(&bb)
+	pattern := []byte("abcdefgh")
+	for _, b := range pattern {
+		w.TryWriteByte(b)
+	}
+	outLen := len(pattern)
+	for outLen < 5*maxWindowSize/2 {
+		b := backref{bType: NewShortBackrefType(), address: outLen - len(pattern), length: 256}
+		b.writeTo(w, outLen)
+		outLen += b.length
+	}
+	w.TryWriteByte(SymbolDynamic)
+	w.TryWriteBits(7, maxBackrefLenLog2)
+	w.TryWriteBits(uint64(maxWindowSize-1), dynamicAddrBits)
+	outLen += 8
+	_, err = w.Align()
+	assert.NoError(err)
+	c = bb.Bytes()
+
+	d, err := Decompress(c, nil)
+	assert.NoError(err)
+	assert.Len(d, outLen)
+
+	dictLen := AugmentedDictLen(nil)
+	total := 0
+	assert.NoError(WalkCompressedStream(c, nil, func(p CompressionPhrase) error {
+		start := p.StartDecompressed - dictLen
+		assert.Equal(total, start)
+		assert.Equal(d[start:start+p.Length], p.Content)
+		total += p.Length
+		return nil
+	}))
+	assert.Equal(outLen, total)
+}
+
+func TestDecompressAugmented(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+	augmented := AugmentDict(dict)
+
+	// augmenting is idempotent
+	assert.Equal(augmented, AugmentDict(augmented))
+	dBack, err := Decompress(c, augmented)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	dBack, err = DecompressAugmented(c, augmented)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	_, err = DecompressAugmented(c, []byte{1, 2, 3})
+	assert.Error(err)
+
+	// a micro backref stream needs SymbolMicro too
+	header := Header{Version: Version, MicroBackrefs: true}
+	var bb bytes.Buffer
+	_, err = header.WriteTo(&bb)
+	assert.NoError(err)
+	bb.WriteString("hello")
+	_, err = DecompressAugmented(bb.Bytes(), []byte{SymbolShort, SymbolDynamic})
+	assert.Error(err)
+	dBack, err = DecompressAugmented(bb.Bytes(), []byte{SymbolShort, SymbolDynamic, SymbolMicro})
+	assert.NoError(err)
+	assert.Equal([]byte("hello"), dBack)
+}
+
+func TestTruncatedStream(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	// a stream cut at a phrase boundary decompresses to a prefix of the data; otherwise the truncation is reported
+	nbTruncated := 0
+	for n := HeaderSize; n < 2000; n++ {
+		dBack, err := Decompress(c[:n], dict)
+		if err != nil {
+			assert.ErrorIs(err, ErrTruncatedStream, "cut at %d", n)
+			assert.ErrorIs(err, io.ErrUnexpectedEOF)
+			nbTruncated++
+			continue
+		}
+		assert.Equal(d[:len(dBack)], dBack, "cut at %d", n)
+	}
+	assert.NotZero(nbTruncated)
+
+	// the streaming decompressor reports the same error
+	n := HeaderSize
+	for ; ; n++ {
+		if _, err = Decompress(c[:n], dict); err != nil {
+			break
+		}
+	}
+	decompressor, err := NewDecompressor(bytes.NewReader(c[:n]), dict)
+	assert.NoError(err)
+	_, err = io.ReadAll(decompressor)
+	assert.ErrorIs(err, ErrTruncatedStream)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	dBack, err := DecompressLimit(c, dict, len(d))
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+	_, err = DecompressLimit(c, dict, len(d)-1)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+	_, err = DecompressLimit(c, dict, -1)
+	assert.Error(err)
+
+	// a bomb: a single literal, repeated by 256-byte backrefs; each 3-byte backref produces 256 bytes
+	var bb bytes.Buffer
+	bb.Write([]byte{0, Version, 0})
+	w := bitio.NewWriter(&bb)
+	w.TryWriteByte('a')
+	for i := 1; i < 1<<20; i += 256 {
+		b := backref{bType: NewShortBackrefType(), address: i - 1, length: 256}
+		b.writeTo(w, i)
+	}
+	_, err = w.Align()
+	assert.NoError(err)
+
+	dBack, err = DecompressLimit(bb.Bytes(), nil, 1<<20+1)
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{'a'}, 1<<20+1), dBack)
+	dBack, err = DecompressLimit(bb.Bytes(), nil, 1000)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+	assert.Nil(dBack)
+
+	// a raw span longer than the limit is rejected from its length alone, before its content is read
+	c = []byte{0, Version, flagRawSpans, SymbolRaw, 0xFF, 0xFF}
+	_, err = DecompressLimit(c, nil, 1000)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+	_, err = DecompressLimit(c, nil, 1<<16)
+	assert.ErrorIs(err, ErrTruncatedStream)
+	_, err = DecompressTo(make([]byte, 1000), c, nil)
+	assert.ErrorIs(err, ErrOutputTooLarge)
+}
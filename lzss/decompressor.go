@@ -0,0 +1,349 @@
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/icza/bitio"
+)
+
+// Decompressor decompresses a stream incrementally, retaining only as much of the
+// decompressed output as backrefs can reach.
+// Its state can be serialized with SnapshotState and restored with RestoreState,
+// so that a long decompression can be resumed later on.
+type Decompressor struct {
+	in     *bitio.Reader
+	header Header
+	dict   []byte
+
+	bitsRead int // number of bits of compressed data consumed so far, including the header
+	nbOut    int // number of bytes decompressed so far
+
+	// window holds the end of the decompressed output; its last pending bytes have not been returned by Read yet
+	window  []byte
+	pending int
+
+	// block container state
+	nbBlocksLeft int               // -1 if unknown, see streamedBlocks
+	block        *Decompressor     // decompressor of the current block, if any
+	blockReader  *io.LimitedReader // compressed data of the current block
+
+	err error // sticky error
+}
+
+// NewDecompressor returns a decompressor reading compressed data from r.
+// The dictionary must be the same as the one used to compress the data.
+// The header is read immediately.
+func NewDecompressor(r io.Reader, dict []byte) (*Decompressor, error) {
+	d := &Decompressor{
+		in:   bitio.NewReader(r),
+		dict: dict,
+	}
+	n, err := d.header.ReadFrom(d.in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if err = checkVersion(d.header.Version); err != nil {
+		return nil, err
+	}
+	d.bitsRead = 8 * int(n)
+	if d.header.Blocks {
+		// the dictionary is passed on as is to the blocks, which augment it according to their own headers
+		nbBlocks, err := d.in.ReadBits(8 * blockFieldSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the number of blocks: %w", err)
+		}
+		d.nbBlocksLeft = int(nbBlocks)
+		if nbBlocks == streamedBlocks {
+			d.nbBlocksLeft = -1
+		}
+		d.bitsRead += 8 * blockFieldSize
+	} else {
+		d.dict = augmentDict(dict, d.header.reservedSymbols()...)
+		if err := d.header.checkDict(d.dict); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// NewReader returns a reader decompressing the compressed data read from r.
+// The output is produced lazily; only the part of it that backrefs can reach is retained.
+func NewReader(r io.Reader, dict []byte) (io.Reader, error) {
+	d, err := NewDecompressor(r, dict)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// rawChunkSize is the number of bytes copied at once when compression is bypassed
+const rawChunkSize = 1 << 16
+
+// maxWindowSize is the furthest a backref can reach back into the decompressed output
+var maxWindowSize = NewDynamicBackrefType(0, 0).maxAddress
+
+// Read implements io.Reader, writing decompressed data to p.
+func (d *Decompressor) Read(p []byte) (n int, err error) {
+	if d.header.Blocks {
+		return d.readBlocks(p)
+	}
+	for n < len(p) {
+		if d.pending == 0 {
+			if d.err != nil {
+				break
+			}
+			d.err = d.step()
+			continue
+		}
+		m := copy(p[n:], d.window[len(d.window)-d.pending:])
+		d.pending -= m
+		n += m
+	}
+	if n == 0 && len(p) != 0 {
+		return 0, d.err
+	}
+	return n, nil
+}
+
+// step decodes a single phrase into the window
+func (d *Decompressor) step() error {
+	if d.header.NoCompression {
+		// no window needed; just copy the input through
+		if cap(d.window) < rawChunkSize {
+			d.window = make([]byte, rawChunkSize)
+		}
+		d.window = d.window[:rawChunkSize]
+		n, err := d.in.Read(d.window)
+		d.window = d.window[:n]
+		d.bitsRead += 8 * n
+		d.nbOut += n
+		d.pending = n
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if n != 0 && err == io.EOF {
+			err = nil // report EOF once the data read has been consumed
+		}
+		return err
+	}
+
+	d.trimWindow()
+
+	s, err := d.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	d.bitsRead += 8
+
+	var b backref
+	switch d.header.phraseType(s) {
+	case SymbolShort:
+		b.bType = d.header.shortBackrefType()
+	case SymbolMicro:
+		b.bType = newMicroBackrefType()
+	case SymbolDynamic:
+		b.bType = d.header.dynamicBackrefType(len(d.dict), d.nbOut)
+	case SymbolRaw:
+		n, err := readRawSpanLen(d.in)
+		if err != nil {
+			return err
+		}
+		if d.window, err = readRawSpan(d.in, d.window, n); err != nil {
+			return err
+		}
+		d.bitsRead += rawLenLog2 + 8*n
+		d.nbOut += n
+		d.pending = n
+		return nil
+	default:
+		d.window = append(d.window, s)
+		d.nbOut++
+		d.pending = 1
+		return nil
+	}
+
+	if err = b.readFrom(d.in); err != nil {
+		return err
+	}
+	d.bitsRead += int(b.bType.NbBitsBackRef) - 8
+
+	if b.address > d.nbOut {
+		if b.bType.Delimiter != SymbolDynamic {
+			return fmt.Errorf("invalid short backref %+v - output is only %d bytes long", b, d.nbOut)
+		}
+		dictStart := len(d.dict) - (b.address - d.nbOut)
+		if dictStart < 0 || dictStart+b.length > len(d.dict) {
+			return fmt.Errorf("invalid dynamic backref %+v - dict is only %d bytes long; dictStart = %d", b, len(d.dict), dictStart)
+		}
+		d.window = append(d.window, d.dict[dictStart:dictStart+b.length]...)
+	} else {
+		if b.address > len(d.window) {
+			return fmt.Errorf("invalid backref %+v - only the last %d bytes of the output are kept", b, len(d.window))
+		}
+		for i := 0; i < b.length; i++ {
+			d.window = append(d.window, d.window[len(d.window)-b.address])
+		}
+	}
+	d.nbOut += b.length
+	d.pending = b.length
+	return nil
+}
+
+// readBlocks reads from a block container, one block at a time
+func (d *Decompressor) readBlocks(p []byte) (n int, err error) {
+	for n < len(p) && d.err == nil {
+		if d.block == nil {
+			d.err = d.nextBlock()
+			continue
+		}
+		m, err := d.block.Read(p[n:])
+		n += m
+		if err == io.EOF {
+			if d.blockReader.N != 0 {
+				err = ErrTruncatedStream // the block is shorter than its declared size
+			} else {
+				d.block, err = nil, nil
+			}
+		}
+		d.err = err
+	}
+	if n == 0 && len(p) != 0 {
+		return 0, d.err
+	}
+	return n, nil
+}
+
+// nextBlock starts decompressing the next block of a container
+func (d *Decompressor) nextBlock() error {
+	if d.nbBlocksLeft == 0 {
+		if _, err := d.in.ReadByte(); err != io.EOF {
+			return errors.New("trailing data after the last block")
+		}
+		return io.EOF
+	}
+	size, err := d.in.ReadBits(8 * blockFieldSize)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncatedStream
+		}
+		return err
+	}
+	if size == 0 && d.nbBlocksLeft < 0 {
+		// end of a streamed container
+		d.nbBlocksLeft = 0
+		return d.nextBlock()
+	}
+	d.blockReader = &io.LimitedReader{R: d.in, N: int64(size)}
+	if d.block, err = NewDecompressor(d.blockReader, d.dict); err != nil {
+		return err
+	}
+	if d.block.header.Blocks {
+		return errNestedBlocks
+	}
+	if d.nbBlocksLeft > 0 {
+		d.nbBlocksLeft--
+	}
+	return nil
+}
+
+// trimWindow discards the part of the window that is out of reach of any backref.
+// It only does so once the window has grown to twice the necessary size, to amortize the cost of copying.
+func (d *Decompressor) trimWindow() {
+	if len(d.window) < 2*maxWindowSize {
+		return
+	}
+	n := copy(d.window, d.window[len(d.window)-maxWindowSize:])
+	d.window = d.window[:n]
+}
+
+// snapshotFieldsSize is the size of the state snapshot, excluding the header and the window
+const snapshotFieldsSize = 8 + 8 + 8
+
+// SnapshotState serializes the state of the decompressor.
+// The state does not include the dictionary nor the compressed data.
+// It consists of the header, the position in the compressed and decompressed streams,
+// and the part of the decompressed output that backrefs may still refer to.
+// Block containers are not supported, in which case SnapshotState returns nil.
+func (d *Decompressor) SnapshotState() []byte {
+	if d.header.Blocks {
+		return nil
+	}
+	window := d.window
+	if d.header.NoCompression {
+		window = window[len(window)-d.pending:] // no backrefs; only keep what the caller hasn't read yet
+	} else if len(window) > maxWindowSize+d.pending {
+		window = window[len(window)-maxWindowSize-d.pending:]
+	}
+
+	var bb bytes.Buffer
+	bb.Grow(d.header.size() + snapshotFieldsSize + len(window))
+	if _, err := d.header.WriteTo(&bb); err != nil {
+		panic(err)
+	}
+	var buf [8]byte
+	for _, v := range []int{d.bitsRead, d.nbOut, d.pending} {
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		bb.Write(buf[:])
+	}
+	bb.Write(window)
+	return bb.Bytes()
+}
+
+// RestoreState restores a state produced by SnapshotState.
+// The decompressor must be freshly created, reading from the beginning of the same compressed data and using the same dictionary as
+// the one the snapshot was taken from. The compressed data up to the snapshot position is skipped without being decompressed.
+func (d *Decompressor) RestoreState(state []byte) error {
+	if d.nbOut != 0 || d.bitsRead != 8*d.header.size() {
+		return errors.New("can only restore the state of a fresh decompressor")
+	}
+
+	var header Header
+	headerSize, err := header.ReadFrom(bytes.NewReader(state))
+	if err != nil {
+		return err
+	}
+	if len(state) < int(headerSize)+snapshotFieldsSize {
+		return errors.New("state too short")
+	}
+	if header != d.header {
+		return errors.New("state was taken from a different compressed stream")
+	}
+
+	var fields [3]int
+	for i := range fields {
+		v := binary.BigEndian.Uint64(state[int(headerSize)+8*i:])
+		if v > math.MaxInt32*8 {
+			return errors.New("invalid state")
+		}
+		fields[i] = int(v)
+	}
+	bitsRead, nbOut, pending := fields[0], fields[1], fields[2]
+	window := state[int(headerSize)+snapshotFieldsSize:]
+	if bitsRead < d.bitsRead || pending > len(window) || len(window) > nbOut {
+		return errors.New("invalid state")
+	}
+	if !d.header.NoCompression && len(window) < min(nbOut, maxWindowSize) {
+		return errors.New("invalid state: the window is shorter than backrefs can reach")
+	}
+
+	// skip the compressed data already processed
+	for ; d.bitsRead+64 <= bitsRead; d.bitsRead += 64 {
+		if _, err := d.in.ReadBits(64); err != nil {
+			return fmt.Errorf("failed to skip compressed data: %w", err)
+		}
+	}
+	if _, err := d.in.ReadBits(uint8(bitsRead - d.bitsRead)); err != nil {
+		return fmt.Errorf("failed to skip compressed data: %w", err)
+	}
+
+	d.bitsRead = bitsRead
+	d.nbOut = nbOut
+	d.pending = pending
+	d.window = append(d.window[:0], window...)
+	return nil
+}
@@ -0,0 +1,188 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressorRead(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+
+	// read everything at once
+	decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	dBack, err := io.ReadAll(decompressor)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// read in small chunks
+	decompressor, err = NewDecompressor(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	var buf [7]byte
+	dBack = dBack[:0]
+	for {
+		n, err := decompressor.Read(buf[:])
+		dBack = append(dBack, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+	}
+	assert.Equal(d, dBack)
+}
+
+func TestDecompressorLargeWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large input in short mode")
+	}
+	assert := require.New(t)
+
+	// the output is large enough for the window to be trimmed
+	var d []byte
+	for len(d) < MaxInputSize {
+		for filename := range refValues {
+			f, err := os.ReadFile(filename)
+			assert.NoError(err)
+			d = append(d, f...)
+		}
+	}
+	d = d[:MaxInputSize]
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+
+	decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	dBack, err := io.ReadAll(decompressor)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+func TestDecompressorSnapshot(t *testing.T) {
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	require.NoError(t, err)
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	require.NoError(t, err)
+
+	c, err := compressor.Compress(d)
+	require.NoError(t, err)
+	c = bytes.Clone(c)
+
+	compressor, err = NewCompressor(dict, WithDictFingerprint())
+	require.NoError(t, err)
+	cFingerprint, err := compressor.Compress(d)
+	require.NoError(t, err)
+
+	var bb bytes.Buffer
+	header := Header{Version: Version, NoCompression: true}
+	_, err = header.WriteTo(&bb)
+	require.NoError(t, err)
+	cNoCompression := append(bb.Bytes(), d...)
+
+	for _, c := range [][]byte{c, cFingerprint, cNoCompression} {
+		for _, half := range []int{0, 1, 1000, len(d) / 2, len(d)} {
+			assert := require.New(t)
+
+			decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+			assert.NoError(err)
+			dBack := make([]byte, half)
+			_, err = io.ReadFull(decompressor, dBack)
+			assert.NoError(err)
+
+			state := decompressor.SnapshotState()
+
+			decompressor, err = NewDecompressor(bytes.NewReader(c), dict)
+			assert.NoError(err)
+			assert.NoError(decompressor.RestoreState(state))
+
+			rest, err := io.ReadAll(decompressor)
+			assert.NoError(err)
+			assert.Equal(d, append(dBack, rest...))
+
+			// restoring twice is not allowed
+			assert.Error(decompressor.RestoreState(state))
+		}
+	}
+}
+
+func TestDecompressorForgedSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	d := []byte(strings.Repeat("hello world, ", 100))
+	compressor, err := NewCompressor(nil)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+
+	decompressor, err := NewDecompressor(bytes.NewReader(c), nil)
+	assert.NoError(err)
+	_, err = io.ReadFull(decompressor, make([]byte, 36))
+	assert.NoError(err)
+	state := decompressor.SnapshotState()
+	headerSize := len(state) - snapshotFieldsSize - 36
+
+	// keep a single byte of the window, none of which is pending
+	forged := bytes.Clone(state[:headerSize+snapshotFieldsSize+1])
+	binary.BigEndian.PutUint64(forged[headerSize+16:], 0)
+	decompressor, err = NewDecompressor(bytes.NewReader(c), nil)
+	assert.NoError(err)
+	assert.Error(decompressor.RestoreState(forged))
+
+	// truncated states
+	for _, n := range []int{0, headerSize, headerSize + snapshotFieldsSize - 1} {
+		decompressor, err = NewDecompressor(bytes.NewReader(c), nil)
+		assert.NoError(err)
+		assert.Error(decompressor.RestoreState(state[:n]))
+	}
+
+	// a backref beyond the window is an error rather than a panic
+	decompressor, err = NewDecompressor(bytes.NewReader(c), nil)
+	assert.NoError(err)
+	assert.NoError(decompressor.RestoreState(state))
+	decompressor.window = decompressor.window[len(decompressor.window)-1:]
+	decompressor.pending = 0
+	_, err = io.ReadAll(decompressor)
+	assert.Error(err)
+}
+
+func TestNewReader(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	c, err := os.ReadFile("./testdata/blobs/5-1128897.lzss")
+	assert.NoError(err)
+
+	// feed the compressed data one byte at a time, and hash the output without buffering it
+	r, err := NewReader(iotest.OneByteReader(bytes.NewReader(c)), getDictionary())
+	assert.NoError(err)
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	assert.NoError(err)
+	expected := sha256.Sum256(d)
+	assert.Equal(expected[:], h.Sum(nil))
+
+	_, err = NewReader(bytes.NewReader(c[:HeaderSize-1]), getDictionary())
+	assert.Error(err)
+}
@@ -0,0 +1,32 @@
+package lzss
+
+import "bytes"
+
+// AugmentDict ensures the dictionary contains the special symbols
+func AugmentDict(dict []byte) []byte {
+	return augmentDict(dict, SymbolShort, SymbolDynamic)
+}
+
+// AugmentedDictLen returns the length of AugmentDict(dict), without allocating.
+// The compressor and the decompressor both augment the dictionary, and dynamic backref addresses are relative to
+// the end of the augmented dictionary, so any external computation on addresses must use this length rather than len(dict).
+// A result different from len(dict) signals a dictionary that is silently extended on use.
+// Streams compressed WithMicroBackrefs also reserve SymbolMicro, and augment the dictionary with three symbols instead.
+// Streams compressed WithDelimiters reserve the chosen delimiters instead of SymbolShort and SymbolDynamic.
+func AugmentedDictLen(dict []byte) int {
+	if bytes.IndexByte(dict, SymbolShort) == -1 || bytes.IndexByte(dict, SymbolDynamic) == -1 {
+		return len(dict) + 2
+	}
+	return len(dict)
+}
+
+// augmentDict ensures the dictionary contains all the given symbols, appending them all if any is missing
+func augmentDict(dict []byte, symbols ...byte) []byte {
+	for _, s := range symbols {
+		if bytes.IndexByte(dict, s) == -1 {
+			// cap the capacity so as not to overwrite the caller's data beyond len(dict)
+			return append(dict[:len(dict):len(dict)], symbols...)
+		}
+	}
+	return dict
+}
@@ -0,0 +1,23 @@
+package lzss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAugmentedDictLen(t *testing.T) {
+	assert := require.New(t)
+
+	for _, dict := range [][]byte{
+		nil,
+		getDictionary(),
+		{1, 2, 3},
+		{SymbolShort},
+		{SymbolDynamic, 1, SymbolShort},
+	} {
+		assert.Equal(len(AugmentDict(dict)), AugmentedDictLen(dict))
+	}
+	assert.Equal(2, AugmentedDictLen(nil))
+	assert.Equal(3, AugmentedDictLen([]byte{SymbolDynamic, 1, SymbolShort}))
+}
@@ -0,0 +1,195 @@
+// Package dictbuilder builds lzss dictionaries out of sample data.
+package dictbuilder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/consensys/compress/lzss"
+	"github.com/consensys/compress/lzss/internal/suffixarray"
+)
+
+const (
+	minMatchLen = 8      // shorter substrings are not worth a dictionary entry
+	maxMatchLen = 1 << 8 // no backref is longer than this
+	backrefCost = 5      // approximate size in bytes of a dynamic backref
+)
+
+// BuildDictionary mines the substrings occurring most frequently across the samples and assembles them
+// into a dictionary of at most maxSize bytes. The most valuable substrings are placed towards the end.
+// The dictionary always ends with the reserved symbols lzss.SymbolShort and lzss.SymbolDynamic, so that
+// lzss.AugmentDict leaves it unchanged.
+func BuildDictionary(samples [][]byte, maxSize int) ([]byte, error) {
+	if maxSize < 2 || maxSize > lzss.MaxDictSize {
+		return nil, fmt.Errorf("dictionary size must be between 2 and %d", lzss.MaxDictSize)
+	}
+
+	// concatenate the samples, keeping track of their boundaries so that substrings do not straddle them
+	total := 0
+	for _, s := range samples {
+		total += len(s)
+	}
+	if total > math.MaxInt32 {
+		return nil, errors.New("samples too large")
+	}
+	text := make([]byte, 0, total)
+	sampleOf := make([]int32, 0, total) // index of the sample each byte of text belongs to
+	ends := make([]int, len(samples))   // end of each sample in text
+	for i, s := range samples {
+		text = append(text, s...)
+		for range s {
+			sampleOf = append(sampleOf, int32(i))
+		}
+		ends[i] = len(text)
+	}
+
+	sa := suffixarray.New(text, make([]int32, len(text))).SA()
+	lcp := computeLCP(text, sa, sampleOf, ends)
+	candidates := findCandidates(sa, lcp, sampleOf, len(samples))
+
+	// sort by score per byte of dictionary
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score*candidates[j].length > candidates[j].score*candidates[i].length
+	})
+
+	// pick the densest candidates that fit, skipping those already in the dictionary.
+	// A candidate extending previous picks replaces them if it is worth more.
+	budget := maxSize - 2
+	var picked []candidate
+	for _, c := range candidates {
+		if budget < minMatchLen {
+			break
+		}
+		s := text[c.pos : c.pos+c.length]
+		replacedScore, replacedLen := 0, 0
+		contained := false
+		for _, p := range picked {
+			ps := text[p.pos : p.pos+p.length]
+			if bytes.Contains(ps, s) {
+				contained = true
+				break
+			}
+			if bytes.Contains(s, ps) {
+				replacedScore += p.score
+				replacedLen += p.length
+			}
+		}
+		if contained || c.score <= replacedScore || c.length-replacedLen > budget {
+			continue
+		}
+		kept := picked[:0]
+		for _, p := range picked {
+			if !bytes.Contains(s, text[p.pos:p.pos+p.length]) {
+				kept = append(kept, p)
+			}
+		}
+		picked = append(kept, c)
+		budget -= c.length - replacedLen
+	}
+
+	dict := make([]byte, 0, maxSize-budget)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, text[picked[i].pos:picked[i].pos+picked[i].length]...)
+	}
+	return append(dict, lzss.SymbolShort, lzss.SymbolDynamic), nil
+}
+
+// computeLCP returns the length of the longest common prefix of each suffix with the previous one in the suffix array,
+// not going past the end of either suffix's sample, and capped at maxMatchLen. lcp[0] and lcp[len(sa)] are zero.
+func computeLCP(text []byte, sa, sampleOf []int32, ends []int) []int {
+	rank := make([]int32, len(sa))
+	for i, p := range sa {
+		rank[p] = int32(i)
+	}
+
+	// Kasai's algorithm, on the raw text
+	lcp := make([]int, len(sa)+1)
+	h := 0
+	for p := range text {
+		r := rank[p]
+		if r == 0 {
+			h = 0
+			continue
+		}
+		q := int(sa[r-1])
+		for p+h < len(text) && q+h < len(text) && text[p+h] == text[q+h] {
+			h++
+		}
+		lcp[r] = h
+		if h > 0 {
+			h--
+		}
+	}
+
+	for r := 1; r < len(sa); r++ {
+		p, q := int(sa[r]), int(sa[r-1])
+		lcp[r] = min(lcp[r], ends[sampleOf[p]]-p, ends[sampleOf[q]]-q, maxMatchLen)
+	}
+	return lcp
+}
+
+type candidate struct {
+	pos, length int
+	score       int
+}
+
+// findCandidates enumerates the repeated substrings of the text, as intervals of the suffix array sharing a common prefix.
+// An interval is a candidate if it is found in more than one sample and is worth more than any of its extensions.
+func findCandidates(sa []int32, lcp []int, sampleOf []int32, nbSamples int) []candidate {
+	type interval struct {
+		lcp, lb   int
+		bestChild int // best score among the sub-intervals
+	}
+
+	var candidates []candidate
+	seen := make([]int, nbSamples) // last interval in which each sample was seen
+	nbIntervals := 0
+
+	// process scores the interval sa[lb:rb] and returns the best score within it
+	process := func(iv interval, rb int) int {
+		if iv.lcp < minMatchLen {
+			return iv.bestChild
+		}
+		nbIntervals++
+		nbDocs := 0
+		for _, p := range sa[iv.lb:rb] {
+			if s := sampleOf[p]; seen[s] != nbIntervals {
+				seen[s] = nbIntervals
+				nbDocs++
+			}
+		}
+		if nbDocs < 2 {
+			return iv.bestChild
+		}
+		score := nbDocs * (iv.lcp - backrefCost)
+		if score <= iv.bestChild {
+			return iv.bestChild
+		}
+		candidates = append(candidates, candidate{pos: int(sa[iv.lb]), length: iv.lcp, score: score})
+		return score
+	}
+
+	stack := []interval{{}}
+	for i := 1; i <= len(sa); i++ {
+		lb := i - 1
+		carry := 0 // best score of the last interval popped, if it is a child of the one about to be pushed
+		for lcp[i] < stack[len(stack)-1].lcp {
+			iv := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			best := process(iv, i)
+			lb = iv.lb
+			if parent := &stack[len(stack)-1]; lcp[i] <= parent.lcp {
+				parent.bestChild = max(parent.bestChild, best)
+			} else {
+				carry = best
+			}
+		}
+		if lcp[i] > stack[len(stack)-1].lcp {
+			stack = append(stack, interval{lcp: lcp[i], lb: lb, bestChild: carry})
+		}
+	}
+	return candidates
+}
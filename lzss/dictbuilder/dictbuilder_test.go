@@ -0,0 +1,86 @@
+//go:build !decompressonly
+
+package dictbuilder
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/consensys/compress/lzss"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildDictionary(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("../testdata/blobs/1-1865800")
+	assert.NoError(err)
+
+	// train on every other chunk, evaluate on the rest
+	const chunkSize = 4096
+	var training, evaluation [][]byte
+	for i := 0; i*chunkSize < len(d); i++ {
+		chunk := d[i*chunkSize : min((i+1)*chunkSize, len(d))]
+		if i%2 == 0 {
+			training = append(training, chunk)
+		} else {
+			evaluation = append(evaluation, chunk)
+		}
+	}
+
+	const maxSize = 1 << 14
+	dict, err := BuildDictionary(training, maxSize)
+	assert.NoError(err)
+	assert.LessOrEqual(len(dict), maxSize)
+	assert.Greater(len(dict), maxSize/2)
+	assert.True(bytes.HasSuffix(dict, []byte{lzss.SymbolShort, lzss.SymbolDynamic}))
+	assert.Equal(dict, lzss.AugmentDict(dict))
+
+	compressedSize := func(dict []byte) int {
+		compressor, err := lzss.NewCompressor(dict)
+		assert.NoError(err)
+		size := 0
+		for _, chunk := range evaluation {
+			c, err := compressor.Compress(chunk)
+			assert.NoError(err)
+			dBack, err := lzss.Decompress(c, dict)
+			assert.NoError(err)
+			assert.Equal(chunk, dBack)
+			size += len(c)
+		}
+		return size
+	}
+
+	withoutDict, withDict := compressedSize(nil), compressedSize(dict)
+	t.Logf("compressed size without dictionary: %d, with trained dictionary: %d", withoutDict, withDict)
+	assert.Less(withDict, withoutDict*95/100)
+}
+
+func TestBuildDictionaryEdgeCases(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := BuildDictionary(nil, 1)
+	assert.Error(err)
+	_, err = BuildDictionary(nil, lzss.MaxDictSize+1)
+	assert.Error(err)
+
+	dict, err := BuildDictionary(nil, 100)
+	assert.NoError(err)
+	assert.Equal([]byte{lzss.SymbolShort, lzss.SymbolDynamic}, dict)
+
+	// substrings repeated within a single sample are left to the compressor
+	dict, err = BuildDictionary([][]byte{bytes.Repeat([]byte("0123456789abcdef"), 10)}, 100)
+	assert.NoError(err)
+	assert.Equal([]byte{lzss.SymbolShort, lzss.SymbolDynamic}, dict)
+
+	// substrings common to several samples are picked, but never straddle two samples
+	common := []byte(" common to all samples")
+	dict, err = BuildDictionary([][]byte{
+		append([]byte("first"), common...),
+		append([]byte("second"), common...),
+		append([]byte("third"), common...),
+	}, 100)
+	assert.NoError(err)
+	assert.Equal(append(common, lzss.SymbolShort, lzss.SymbolDynamic), dict)
+}
@@ -3,32 +3,107 @@ package lzss
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 )
 
 const (
 	// Version is the current release version of the compressor.
 	Version    = 1
-	HeaderSize = 3
+	HeaderSize = 3 // size of a header without dictionary fingerprint
+
+	dictFingerprintSize = 4
+	delimitersSize      = 2
 )
 
 // Header is the header of a compressed data.
-// It contains the compressor release version and the compression level.
+// It contains the compressor release version and the flags describing the encoding of the data.
 type Header struct {
 	Version       uint16 // compressor release version
 	NoCompression bool
+	Blocks        bool // the data is a sequence of independently compressed blocks, see CompressParallel
+	LongBackrefs  bool // backref lengths are encoded on 16 bits instead of 8, see WithLongBackrefs
+	MicroBackrefs bool // SymbolMicro is reserved for micro backrefs, see WithMicroBackrefs
+	// dynamic backref addresses are only as wide as needed to reach the beginning of the dictionary, see WithAdaptiveAddresses
+	AdaptiveAddresses bool
+	// the header ends with DictFingerprint, checked against the dictionary upon decompression, see WithDictFingerprint
+	HasDictFingerprint bool
+	DictFingerprint    uint32
+	RawSpans           bool // SymbolRaw is reserved for spans of bytes stored verbatim, see WithRawSpans
+	// short and dynamic backrefs start with ShortDelimiter and DynamicDelimiter instead of SymbolShort and SymbolDynamic,
+	// which follow the flags in the header, see WithDelimiters
+	CustomDelimiters bool
+	ShortDelimiter   byte
+	DynamicDelimiter byte
 }
 
+// flags packed in the third byte of the header.
+// With no other flag set, this byte is the same as the NoCompression boolean of earlier releases.
+const (
+	flagNoCompression byte = 1 << iota
+	flagBlocks
+	flagLongBackrefs
+	flagMicroBackrefs
+	flagAdaptiveAddresses
+	flagDictFingerprint
+	flagRawSpans
+	flagCustomDelimiters
+
+	knownFlags = flagNoCompression | flagBlocks | flagLongBackrefs | flagMicroBackrefs | flagAdaptiveAddresses | flagDictFingerprint | flagRawSpans | flagCustomDelimiters
+)
+
 func (s *Header) WriteTo(w io.Writer) (int64, error) {
+	if err := s.check(); err != nil {
+		return 0, err
+	}
 	if err := binary.Write(w, binary.BigEndian, uint16(s.Version)); err != nil {
 		return 0, err
 	}
 
-	if _, err := w.Write([]byte{ind(s.NoCompression)}); err != nil {
+	var flags byte
+	if s.NoCompression {
+		flags |= flagNoCompression
+	}
+	if s.Blocks {
+		flags |= flagBlocks
+	}
+	if s.LongBackrefs {
+		flags |= flagLongBackrefs
+	}
+	if s.MicroBackrefs {
+		flags |= flagMicroBackrefs
+	}
+	if s.AdaptiveAddresses {
+		flags |= flagAdaptiveAddresses
+	}
+	if s.HasDictFingerprint {
+		flags |= flagDictFingerprint
+	}
+	if s.RawSpans {
+		flags |= flagRawSpans
+	}
+	if s.CustomDelimiters {
+		flags |= flagCustomDelimiters
+	}
+	if _, err := w.Write([]byte{flags}); err != nil {
 		return 2, err
 	}
 
-	return HeaderSize, nil
+	n := HeaderSize
+	if s.CustomDelimiters {
+		if _, err := w.Write([]byte{s.ShortDelimiter, s.DynamicDelimiter}); err != nil {
+			return int64(n), err
+		}
+		n += delimitersSize
+	}
+	if s.HasDictFingerprint {
+		if err := binary.Write(w, binary.BigEndian, s.DictFingerprint); err != nil {
+			return int64(n), err
+		}
+	}
+
+	return int64(s.size()), nil
 }
 
 func (s *Header) ReadFrom(r io.Reader) (int64, error) {
@@ -39,25 +114,156 @@ func (s *Header) ReadFrom(r io.Reader) (int64, error) {
 	}
 
 	s.Version = binary.BigEndian.Uint16(b[:2])
-	s.NoCompression, err = indInv(b[2])
-	return int64(n), err
+	flags := b[2]
+	if flags&^knownFlags != 0 {
+		return int64(n), fmt.Errorf("unknown header flags 0x%x", flags&^knownFlags)
+	}
+	s.NoCompression = flags&flagNoCompression != 0
+	s.Blocks = flags&flagBlocks != 0
+	s.LongBackrefs = flags&flagLongBackrefs != 0
+	s.MicroBackrefs = flags&flagMicroBackrefs != 0
+	s.AdaptiveAddresses = flags&flagAdaptiveAddresses != 0
+	s.HasDictFingerprint = flags&flagDictFingerprint != 0
+	s.RawSpans = flags&flagRawSpans != 0
+	s.CustomDelimiters = flags&flagCustomDelimiters != 0
+	s.ShortDelimiter, s.DynamicDelimiter = 0, 0
+	s.DictFingerprint = 0
+	if s.CustomDelimiters {
+		var delimiters [delimitersSize]byte
+		m, err := io.ReadFull(r, delimiters[:])
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+		s.ShortDelimiter, s.DynamicDelimiter = delimiters[0], delimiters[1]
+	}
+	if err := s.check(); err != nil {
+		return int64(n), err
+	}
+
+	if s.HasDictFingerprint {
+		var fp [dictFingerprintSize]byte
+		m, err := io.ReadFull(r, fp[:])
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+		s.DictFingerprint = binary.BigEndian.Uint32(fp[:])
+	}
+	return int64(n), nil
 }
 
-// ind indicator function
-func ind(b bool) byte {
-	if b {
-		return 1
+// check rejects the combinations of flags that make no sense
+func (s *Header) check() error {
+	if s.Blocks && s.NoCompression {
+		return errors.New("a block container cannot bypass compression")
+	}
+	if (s.LongBackrefs || s.MicroBackrefs || s.AdaptiveAddresses || s.HasDictFingerprint || s.RawSpans || s.CustomDelimiters) && (s.NoCompression || s.Blocks) {
+		return errors.New("backref and dictionary flags only apply to compressed data")
+	}
+	if s.CustomDelimiters {
+		if s.ShortDelimiter == s.DynamicDelimiter {
+			return errors.New("the short and dynamic delimiters must be different")
+		}
+		for _, d := range []byte{s.ShortDelimiter, s.DynamicDelimiter} {
+			if (d == SymbolMicro && s.MicroBackrefs) || (d == SymbolRaw && s.RawSpans) {
+				return fmt.Errorf("delimiter 0x%x is already reserved", d)
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the size of the header in bytes
+func (s *Header) size() int {
+	size := HeaderSize
+	if s.CustomDelimiters {
+		size += delimitersSize
+	}
+	if s.HasDictFingerprint {
+		size += dictFingerprintSize
+	}
+	return size
+}
+
+// ErrDictMismatch is returned when decompressing data with a different dictionary than the one it was compressed with.
+// It can only be detected for data compressed WithDictFingerprint.
+var ErrDictMismatch = errors.New("dictionary mismatch")
+
+// checkDict checks the augmented dictionary against the fingerprint, if any
+func (s *Header) checkDict(dict []byte) error {
+	if s.HasDictFingerprint && s.DictFingerprint != dictFingerprint(dict) {
+		return ErrDictMismatch
+	}
+	return nil
+}
+
+// dictFingerprint returns the fingerprint of an augmented dictionary
+func dictFingerprint(dict []byte) uint32 {
+	return crc32.ChecksumIEEE(dict)
+}
+
+// backrefLenLog2 returns the number of bits encoding the length of backrefs
+func (s *Header) backrefLenLog2() uint8 {
+	if s.LongBackrefs {
+		return longBackrefLenLog2
+	}
+	return maxBackrefLenLog2
+}
+
+// delimiters returns the symbols starting short and dynamic backrefs
+func (s *Header) delimiters() (short, dynamic byte) {
+	if s.CustomDelimiters {
+		return s.ShortDelimiter, s.DynamicDelimiter
+	}
+	return SymbolShort, SymbolDynamic
+}
+
+// shortBackrefType returns the type of short backrefs
+func (s *Header) shortBackrefType() BackrefType {
+	t := newShortBackrefType(s.backrefLenLog2())
+	t.symbol, _ = s.delimiters()
+	return t
+}
+
+// dynamicBackrefType returns the type of dynamic backrefs, given the dictionary length and the number of bytes decompressed so far
+func (s *Header) dynamicBackrefType(dictLen, addressableBytes int) BackrefType {
+	t := newDynamicBackrefType(dictLen, addressableBytes, s.backrefLenLog2(), s.AdaptiveAddresses)
+	_, t.symbol = s.delimiters()
+	return t
+}
+
+// phraseType returns the type of the phrase starting with symbol b: SymbolShort, SymbolDynamic, SymbolMicro or SymbolRaw,
+// whatever the delimiters, or 0 for a literal
+func (s *Header) phraseType(b byte) byte {
+	short, dynamic := s.delimiters()
+	switch {
+	case b == short:
+		return SymbolShort
+	case b == dynamic:
+		return SymbolDynamic
+	case b == SymbolMicro && s.MicroBackrefs:
+		return SymbolMicro
+	case b == SymbolRaw && s.RawSpans:
+		return SymbolRaw
 	}
 	return 0
 }
 
-// indInv is inverse to ind
-func indInv(b byte) (bool, error) {
-	if b == 0 {
-		return false, nil
+// reservedSymbols returns the symbols that cannot be encoded as literals, and must thus be in the dictionary
+func (s *Header) reservedSymbols() []byte {
+	short, dynamic := s.delimiters()
+	symbols := []byte{short, dynamic}
+	if s.MicroBackrefs {
+		symbols = append(symbols, SymbolMicro)
 	}
-	if b == 1 {
-		return true, nil
+	if s.RawSpans {
+		symbols = append(symbols, SymbolRaw)
 	}
-	return false, errors.New("expected 0 or 1")
+	return symbols
+}
+
+// isReserved returns true if the symbol cannot be encoded as a literal
+func (s *Header) isReserved(b byte) bool {
+	return s.phraseType(b) != 0
 }
@@ -24,3 +24,113 @@ func TestHeaderRoundTrip(t *testing.T) {
 
 	assert.Equal(h, h2)
 }
+
+func TestHeaderBlocksRoundTrip(t *testing.T) {
+	assert := require.New(t)
+	h := Header{
+		Version: Version,
+		Blocks:  true,
+	}
+
+	var buf bytes.Buffer
+	_, err := h.WriteTo(&buf)
+	assert.NoError(err)
+
+	var h2 Header
+	_, err = h2.ReadFrom(&buf)
+	assert.NoError(err)
+
+	assert.Equal(h, h2)
+
+	// nothing is written for an invalid header
+	h.NoCompression = true
+	buf.Reset()
+	n, err := h.WriteTo(&buf)
+	assert.Error(err)
+	assert.Zero(n)
+	assert.Zero(buf.Len())
+}
+
+func TestHeaderFlags(t *testing.T) {
+	assert := require.New(t)
+
+	h := Header{Version: Version, LongBackrefs: true}
+	var buf bytes.Buffer
+	_, err := h.WriteTo(&buf)
+	assert.NoError(err)
+	assert.Equal([]byte{0, Version, flagLongBackrefs}, buf.Bytes())
+
+	var h2 Header
+	_, err = h2.ReadFrom(&buf)
+	assert.NoError(err)
+	assert.Equal(h, h2)
+
+	// the NoCompression flag alone is the legacy boolean byte
+	for noc, expected := range []Header{{Version: Version}, {Version: Version, NoCompression: true}} {
+		_, err = h2.ReadFrom(bytes.NewReader([]byte{0, Version, byte(noc)}))
+		assert.NoError(err)
+		assert.Equal(expected, h2)
+	}
+
+	h = Header{Version: Version, LongBackrefs: true, MicroBackrefs: true, AdaptiveAddresses: true, RawSpans: true}
+	buf.Reset()
+	_, err = h.WriteTo(&buf)
+	assert.NoError(err)
+	assert.Equal([]byte{0, Version, flagLongBackrefs | flagMicroBackrefs | flagAdaptiveAddresses | flagRawSpans}, buf.Bytes())
+	assert.Equal([]byte{SymbolShort, SymbolDynamic, SymbolMicro, SymbolRaw}, h.reservedSymbols())
+	_, err = h2.ReadFrom(&buf)
+	assert.NoError(err)
+	assert.Equal(h, h2)
+
+	h = Header{Version: Version, HasDictFingerprint: true, DictFingerprint: 0x01020304}
+	buf.Reset()
+	n, err := h.WriteTo(&buf)
+	assert.NoError(err)
+	assert.Equal(int64(HeaderSize+dictFingerprintSize), n)
+	assert.Equal([]byte{0, Version, flagDictFingerprint, 1, 2, 3, 4}, buf.Bytes())
+	_, err = h2.ReadFrom(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	assert.Equal(h, h2)
+	_, err = h2.ReadFrom(bytes.NewReader(buf.Bytes()[:HeaderSize+1]))
+	assert.Error(err)
+
+	// the delimiters precede the fingerprint
+	h = Header{Version: Version, CustomDelimiters: true, ShortDelimiter: 0xFA, DynamicDelimiter: 0xFB, HasDictFingerprint: true, DictFingerprint: 0x01020304}
+	buf.Reset()
+	n, err = h.WriteTo(&buf)
+	assert.NoError(err)
+	assert.Equal(int64(h.size()), n)
+	assert.Equal([]byte{0, Version, flagCustomDelimiters | flagDictFingerprint, 0xFA, 0xFB, 1, 2, 3, 4}, buf.Bytes())
+	_, err = h2.ReadFrom(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	assert.Equal(h, h2)
+	assert.Equal([]byte{0xFA, 0xFB}, h.reservedSymbols())
+	assert.Equal(SymbolDynamic, h.phraseType(0xFB))
+	assert.Equal(byte(0), h.phraseType(SymbolDynamic))
+	_, err = h2.ReadFrom(bytes.NewReader([]byte{0, Version, flagCustomDelimiters, 0xFA, 0xFA}))
+	assert.Error(err)
+	_, err = h2.ReadFrom(bytes.NewReader([]byte{0, Version, flagCustomDelimiters | flagMicroBackrefs, SymbolMicro, 0xFA}))
+	assert.Error(err)
+
+	for _, flags := range []byte{
+		flagNoCompression | flagBlocks,
+		flagNoCompression | flagLongBackrefs,
+		flagBlocks | flagLongBackrefs,
+		flagNoCompression | flagMicroBackrefs,
+		flagBlocks | flagMicroBackrefs,
+		flagBlocks | flagAdaptiveAddresses,
+		flagNoCompression | flagDictFingerprint,
+		flagBlocks | flagRawSpans,
+		flagNoCompression | flagCustomDelimiters,
+	} {
+		_, err = h2.ReadFrom(bytes.NewReader([]byte{0, Version, flags}))
+		assert.Error(err, "flags 0x%x", flags)
+	}
+
+	h.NoCompression = true
+	buf.Reset()
+	n, err = h.WriteTo(&buf)
+	assert.Error(err)
+	assert.Zero(n)
+	assert.Zero(buf.Len())
+}
@@ -50,12 +50,20 @@ func (x *Index) Bytes() []byte {
 	return x.data
 }
 
+// SA returns the suffix array: the starting positions of the suffixes of the data, in lexicographic order.
+// It must not be modified.
+func (x *Index) SA() []int32 {
+	return x.sa
+}
+
 func (x *Index) at(i int) []byte {
 	return x.data[x.sa[i]:]
 }
 
 // LookupLongest returns an index and length of the longest
 // substring of s[:minEnd] / s[:maxEnd] that occurs in the indexed data.
+// Only occurrences starting in [rangeStart, rangeEnd) are considered; they may extend beyond rangeEnd.
+// If there is none, it returns -1, -1.
 func (x *Index) LookupLongest(s []byte, minEnd, maxEnd, rangeStart, rangeEnd int) (index, length int) {
 	index, length = -1, -1
 
@@ -0,0 +1,37 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"github.com/consensys/compress/lzss/internal/suffixarray"
+)
+
+// Matcher finds repetitions within a piece of data, using the same suffix array index as the compressor.
+// The index is built once, in time and space linear in the size of the data, after which each lookup is logarithmic.
+// A Matcher is safe for concurrent use.
+type Matcher struct {
+	data  []byte
+	index *suffixarray.Index
+}
+
+// NewMatcher indexes data, which must not be modified while the Matcher is in use.
+func NewMatcher(data []byte) *Matcher {
+	return &Matcher{
+		data:  data,
+		index: suffixarray.New(data, make([]int32, len(data))),
+	}
+}
+
+// LongestMatch returns the longest prefix of data[at:at+maxLen] at least minLen bytes long that also occurs at some
+// position addr in the window [windowStart, windowEnd), along with its length. Only the start of the occurrence
+// is constrained to the window: it may extend beyond windowEnd, and even overlap data[at:] itself, as backrefs do.
+// With windowEnd = at, this is the lookup the compressor makes for a backref at position at.
+// If there are several occurrences of the longest prefix in the window, any of them may be returned.
+// If there is none at least minLen bytes long, LongestMatch returns -1, -1.
+func (m *Matcher) LongestMatch(at, minLen, maxLen, windowStart, windowEnd int) (addr, length int) {
+	maxLen = min(maxLen, len(m.data)-at)
+	if minLen <= 0 || minLen > maxLen {
+		return -1, -1
+	}
+	return m.index.LookupLongest(m.data[at:at+maxLen], minLen, maxLen, max(0, windowStart), min(windowEnd, len(m.data)))
+}
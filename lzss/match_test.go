@@ -0,0 +1,71 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher(t *testing.T) {
+	assert := require.New(t)
+
+	data := []byte("abcdeXabcdYabcdeZaaaaaaaa")
+	m := NewMatcher(data)
+
+	// "abcde" at 11 occurs at 0, and "abcd" at 6
+	addr, length := m.LongestMatch(11, 2, 100, 0, 11)
+	assert.Equal(0, addr)
+	assert.Equal(5, length)
+	addr, length = m.LongestMatch(11, 2, 100, 1, 11)
+	assert.Equal(6, addr)
+	assert.Equal(4, length)
+	addr, length = m.LongestMatch(11, 2, 3, 0, 11)
+	assert.Contains([]int{0, 6}, addr)
+	assert.Equal(3, length)
+
+	// the occurrence may overlap the match itself
+	addr, length = m.LongestMatch(18, 1, 100, 17, 18)
+	assert.Equal(17, addr)
+	assert.Equal(7, length)
+
+	// no occurrence in the window, or too short
+	addr, length = m.LongestMatch(11, 2, 100, 7, 11)
+	assert.Equal(-1, addr)
+	assert.Equal(-1, length)
+	addr, length = m.LongestMatch(11, 6, 100, 0, 11)
+	assert.Equal(-1, addr)
+	assert.Equal(-1, length)
+	addr, length = m.LongestMatch(len(data)-1, 2, 100, 0, len(data))
+	assert.Equal(-1, addr)
+	assert.Equal(-1, length)
+
+	// consistent with a brute force search
+	d := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 20)
+	for i := range d {
+		d[i] ^= byte(i * i % 7)
+	}
+	m = NewMatcher(d)
+	for at := 0; at < len(d); at += 7 {
+		windowStart := max(0, at-100)
+		best := -1
+		for j := windowStart; j < at; j++ {
+			l := 0
+			for at+l < len(d) && l < 50 && d[j+l] == d[at+l] {
+				l++
+			}
+			best = max(best, l)
+		}
+		addr, length := m.LongestMatch(at, 1, 50, windowStart, at)
+		if best < 1 {
+			assert.Equal(-1, length)
+			continue
+		}
+		assert.Equal(best, length, "at %d", at)
+		assert.GreaterOrEqual(addr, windowStart)
+		assert.Less(addr, at)
+		assert.Equal(d[at:at+length], d[addr:addr+length])
+	}
+}
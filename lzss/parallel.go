@@ -0,0 +1,73 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// CompressParallel splits d into blocks of blockSize bytes (the last one possibly shorter),
+// compresses them independently and concurrently, and returns them as a block container.
+// Backrefs cannot cross block boundaries, so the compression ratio is slightly worse than that of Compress,
+// but the total input size is not limited to MaxInputSize.
+// All blocks share the compressor's dictionary. The state of the compressor is not modified.
+func (compressor *Compressor) CompressParallel(d []byte, blockSize int) ([]byte, error) {
+	if blockSize <= 0 || blockSize > MaxInputSize {
+		return nil, fmt.Errorf("block size must be in (0, %d]", MaxInputSize)
+	}
+	nbBlocks := (len(d) + blockSize - 1) / blockSize
+	if uint64(nbBlocks) >= streamedBlocks {
+		return nil, fmt.Errorf("too many blocks: %d", nbBlocks)
+	}
+
+	blocks := make([][]byte, nbBlocks)
+	errs := make([]error, nbBlocks)
+
+	// each worker reuses its own compressor, sharing the dictionary index
+	indices := make(chan int, nbBlocks)
+	for i := range blocks {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	nbWorkers := min(runtime.GOMAXPROCS(0), nbBlocks)
+	wg.Add(nbWorkers)
+	for w := 0; w < nbWorkers; w++ {
+		go func() {
+			defer wg.Done()
+			bc := newCompressor(compressor.dictData, compressor.dictIndex, compressor.dictSa, min(blockSize, len(d)), compressor.settings)
+			for i := range indices {
+				if _, err := bc.Compress(d[i*blockSize : min((i+1)*blockSize, len(d))]); err != nil {
+					errs[i] = err
+					continue
+				}
+				bc.ConsiderBypassing()
+				blocks[i] = bytes.Clone(bc.Bytes())
+			}
+		}()
+	}
+	wg.Wait()
+
+	var out bytes.Buffer
+	header := Header{Version: Version, Blocks: true}
+	if _, err := header.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	var buf [blockFieldSize]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(nbBlocks))
+	out.Write(buf[:])
+	for i, block := range blocks {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("block %d: %w", i, errs[i])
+		}
+		binary.BigEndian.PutUint32(buf[:], uint32(len(block)))
+		out.Write(buf[:])
+		out.Write(block)
+	}
+	return out.Bytes(), nil
+}
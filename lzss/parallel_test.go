@@ -0,0 +1,86 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressParallel(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/1-goerli-3690632")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	cSerial, err := compressor.Compress(d)
+	assert.NoError(err)
+	lenSerial := len(cSerial)
+
+	for _, blockSize := range []int{len(d) / 4, 100000, len(d), 2 * len(d)} {
+		c, err := compressor.CompressParallel(d, blockSize)
+		assert.NoError(err)
+
+		dBack, err := Decompress(c, dict)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		r, err := NewReader(bytes.NewReader(c), dict)
+		assert.NoError(err)
+		dBack, err = io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(d, dBack)
+
+		if blockSize >= len(d) {
+			// a single block: same as serial compression, plus the container overhead
+			assert.Equal(lenSerial+HeaderSize+2*blockFieldSize, len(c))
+		}
+	}
+
+	// the compressor is left untouched
+	assert.Equal(cSerial, compressor.Bytes())
+	assert.Equal(lenSerial, compressor.Len())
+}
+
+func TestCompressParallelEdgeCases(t *testing.T) {
+	assert := require.New(t)
+
+	dict := getDictionary()
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	_, err = compressor.CompressParallel([]byte{1}, 0)
+	assert.Error(err)
+
+	// no blocks at all
+	c, err := compressor.CompressParallel(nil, 10)
+	assert.NoError(err)
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Empty(dBack)
+
+	// blocks that expand are stored uncompressed
+	d := craftExpandingInput(dict, 1000)
+	d = append(d, make([]byte, 1000)...)
+	c, err = compressor.CompressParallel(d, 1000)
+	assert.NoError(err)
+	dBack, err = Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// malformed containers
+	_, err = Decompress(c[:len(c)-1], dict)
+	assert.Error(err)
+	_, err = Decompress(append(c, 0), dict)
+	assert.Error(err)
+	nested := append(bytes.Clone(c[:HeaderSize]), 0, 0, 0, 1, 0, 0, 0, byte(len(c)))
+	_, err = Decompress(append(nested, c...), dict)
+	assert.ErrorIs(err, errNestedBlocks)
+}
@@ -1,3 +1,5 @@
+//go:build !decompressonly
+
 package lzss
 
 import (
@@ -0,0 +1,120 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WindowedCompressor compresses input of unbounded length to an io.Writer, as a block container
+// each block of which holds windowBytes of input, the last one possibly less.
+// A block boundary resets the window: backrefs reach the dictionary and the input of their own block, but not that of
+// the previous blocks. Resetting rather than sliding the window keeps the dictionary, and the reserved symbols it holds,
+// within reach of every backref.
+// Blocks are written out as soon as they are full, so memory use is bounded by windowBytes.
+// The output can be decompressed by Decompress and NewDecompressor.
+type WindowedCompressor struct {
+	w           io.Writer
+	compressor  *Compressor
+	windowBytes int
+	started     bool  // whether the header of the container has been written
+	err         error // sticky error
+}
+
+var errWindowedCompressorClosed = errors.New("windowed compressor is closed")
+
+// NewWindowedCompressor returns a compressor writing to w, whose window is reset every windowBytes of input.
+// windowBytes must be at most MaxInputSize; the memory footprint of the compressor is proportional to it.
+func NewWindowedCompressor(w io.Writer, dict []byte, windowBytes int, opts ...Option) (*WindowedCompressor, error) {
+	compressor, err := NewCompressorWithLimits(dict, windowBytes, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &WindowedCompressor{
+		w:           w,
+		compressor:  compressor,
+		windowBytes: windowBytes,
+	}, nil
+}
+
+// Write compresses d, writing out the blocks it completes.
+func (wc *WindowedCompressor) Write(d []byte) (n int, err error) {
+	if wc.err != nil {
+		return 0, wc.err
+	}
+	for len(d) != 0 {
+		m := min(len(d), wc.windowBytes-wc.compressor.Written())
+		if _, err = wc.compressor.Write(d[:m]); err != nil {
+			wc.err = err
+			return n, err
+		}
+		n += m
+		d = d[m:]
+		if wc.compressor.Written() == wc.windowBytes {
+			if err = wc.writeBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes out the last block, if any, and ends the container. It does not close the underlying writer.
+func (wc *WindowedCompressor) Close() error {
+	if wc.err != nil {
+		return wc.err
+	}
+	if wc.compressor.Written() != 0 {
+		if err := wc.writeBlock(); err != nil {
+			return err
+		}
+	}
+	var buf [blockFieldSize]byte
+	if err := wc.write(buf[:]); err != nil {
+		return err
+	}
+	wc.err = errWindowedCompressorClosed
+	return nil
+}
+
+// writeBlock writes out the current block and resets the window
+func (wc *WindowedCompressor) writeBlock() error {
+	wc.compressor.ConsiderBypassing()
+	block := wc.compressor.Bytes()
+	var buf [blockFieldSize]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(block)))
+	if err := wc.write(buf[:]); err != nil {
+		return err
+	}
+	if err := wc.write(block); err != nil {
+		return err
+	}
+	wc.compressor.Reset()
+	return nil
+}
+
+// write writes p to the underlying writer, preceded by the header of the container if nothing was written yet
+func (wc *WindowedCompressor) write(p []byte) error {
+	if !wc.started {
+		wc.started = true
+		var header bytes.Buffer
+		if _, err := (&Header{Version: Version, Blocks: true}).WriteTo(&header); err != nil {
+			wc.err = err
+			return err
+		}
+		var buf [blockFieldSize]byte
+		binary.BigEndian.PutUint32(buf[:], streamedBlocks)
+		header.Write(buf[:])
+		if err := wc.write(header.Bytes()); err != nil {
+			return err
+		}
+	}
+	if _, err := wc.w.Write(p); err != nil {
+		wc.err = err
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowedCompressor(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:100000]
+	dict := getDictionary()
+
+	var out bytes.Buffer
+	wc, err := NewWindowedCompressor(&out, dict, 30000)
+	assert.NoError(err)
+	for i := 0; i < len(d); i += 7000 {
+		n, err := wc.Write(d[i:min(i+7000, len(d))])
+		assert.NoError(err)
+		assert.Equal(min(7000, len(d)-i), n)
+	}
+	assert.Greater(out.Len(), 0, "full blocks are written out before Close")
+	assert.NoError(wc.Close())
+	_, err = wc.Write(d)
+	assert.Error(err)
+	c := out.Bytes()
+
+	dBack, err := Decompress(c, dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	dBack, n, err := DecompressN(append(bytes.Clone(c), 1, 2, 3), dict)
+	assert.NoError(err)
+	assert.Equal(len(c), n)
+	assert.Equal(d, dBack)
+
+	decompressor, err := NewDecompressor(bytes.NewReader(c), dict)
+	assert.NoError(err)
+	dBack, err = io.ReadAll(decompressor)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+
+	// without the final empty block, the container is truncated
+	_, err = Decompress(c[:len(c)-blockFieldSize], dict)
+	assert.ErrorIs(err, ErrTruncatedStream)
+	decompressor, err = NewDecompressor(bytes.NewReader(c[:len(c)-blockFieldSize]), dict)
+	assert.NoError(err)
+	_, err = io.ReadAll(decompressor)
+	assert.ErrorIs(err, ErrTruncatedStream)
+
+	// empty input
+	out.Reset()
+	wc, err = NewWindowedCompressor(&out, dict, 30000)
+	assert.NoError(err)
+	assert.NoError(wc.Close())
+	dBack, err = Decompress(out.Bytes(), dict)
+	assert.NoError(err)
+	assert.Empty(dBack)
+
+	for _, windowBytes := range []int{0, MaxInputSize + 1} {
+		_, err = NewWindowedCompressor(&out, dict, windowBytes)
+		assert.Error(err)
+	}
+}
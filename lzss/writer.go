@@ -0,0 +1,69 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"errors"
+	"io"
+)
+
+// Writer compresses the data written to it and forwards the compressed bytes to an underlying writer
+// as soon as they are final.
+// Since backrefs may point anywhere in the input, the total input is still limited to MaxInputSize.
+type Writer struct {
+	compressor *Compressor
+	w          io.Writer
+	flushed    int // number of compressed bytes already forwarded to w
+	closed     bool
+	err        error // sticky error
+}
+
+// NewWriter returns a Writer compressing data with the given dictionary and writing the result to w.
+// Close must be called to write the last compressed byte.
+func NewWriter(w io.Writer, dict []byte) (*Writer, error) {
+	compressor, err := NewCompressor(dict)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{compressor: compressor, w: w}, nil
+}
+
+// Write compresses p and writes all the compressed bytes that are final to the underlying writer.
+// The last compressed byte may still be completed by a subsequent Write and is held back until then.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, errors.New("write to closed lzss.Writer")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if n, err = w.compressor.Write(p); err != nil {
+		w.err = err
+		return
+	}
+	return n, w.flush(w.compressor.Len() - 1)
+}
+
+// Close writes the remaining compressed data to the underlying writer.
+// It does not close the underlying writer.
+// If a previous Write failed, nothing more is written and Close returns that error.
+func (w *Writer) Close() error {
+	if w.closed || w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	return w.flush(w.compressor.Len())
+}
+
+// flush forwards the compressed bytes up to end to the underlying writer
+func (w *Writer) flush(end int) error {
+	if end <= w.flushed {
+		return nil
+	}
+	n, err := w.w.Write(w.compressor.Bytes()[w.flushed:end])
+	w.flushed += n
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
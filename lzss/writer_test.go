@@ -0,0 +1,105 @@
+//go:build !decompressonly
+
+package lzss
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:100000]
+	dict := getDictionary()
+
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+
+	var bb bytes.Buffer
+	w, err := NewWriter(&bb, dict)
+	assert.NoError(err)
+
+	const chunkSize = 10000
+	for i := 0; i < len(d); i += chunkSize {
+		_, err = compressor.Write(d[i : i+chunkSize])
+		assert.NoError(err)
+		_, err = w.Write(d[i : i+chunkSize])
+		assert.NoError(err)
+
+		// everything but the last byte has been flushed
+		assert.Equal(compressor.Bytes()[:compressor.Len()-1], bb.Bytes())
+	}
+	assert.NoError(w.Close())
+	assert.Equal(compressor.Bytes(), bb.Bytes())
+
+	_, err = w.Write(d[:1])
+	assert.Error(err)
+
+	dBack, err := Decompress(bb.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}
+
+func TestWriterCopy(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	dict := getDictionary()
+
+	// io.Copy into the writer, and back out through the reader
+	var bb bytes.Buffer
+	w, err := NewWriter(&bb, dict)
+	assert.NoError(err)
+	_, err = io.Copy(w, bytes.NewReader(d[:200000]))
+	assert.NoError(err)
+	assert.NoError(w.Close())
+
+	r, err := NewReader(&bb, dict)
+	assert.NoError(err)
+	dBack, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(d[:200000], dBack)
+}
+
+func TestWriterError(t *testing.T) {
+	assert := require.New(t)
+
+	d, err := os.ReadFile("./testdata/blobs/5-1128897")
+	assert.NoError(err)
+	d = d[:1000]
+	dict := getDictionary()
+
+	var bb bytes.Buffer
+	w, err := NewWriter(&bb, dict)
+	assert.NoError(err)
+	_, err = w.Write(d)
+	assert.NoError(err)
+
+	// the input is too large; the error sticks
+	_, err = w.Write(make([]byte, MaxInputSize))
+	assert.Error(err)
+	_, err = w.Write(d)
+	assert.Error(err)
+	assert.Error(w.Close())
+	assert.Error(w.Close())
+
+	// the compressor is left as it was before the failed write
+	compressor, err := NewCompressor(dict)
+	assert.NoError(err)
+	c, err := compressor.Compress(d)
+	assert.NoError(err)
+	_, err = compressor.Write(make([]byte, MaxInputSize))
+	assert.Error(err)
+	assert.Equal(c, compressor.Bytes())
+	dBack, err := Decompress(compressor.Bytes(), dict)
+	assert.NoError(err)
+	assert.Equal(d, dBack)
+}